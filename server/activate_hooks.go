@@ -13,6 +13,9 @@ import (
 // This demo implementation logs a message to the demo channel whenever the plugin is activated.
 // It also creates a demo bot account
 func (p *Plugin) OnActivate() error {
+	p.metrics = newMetrics()
+	p.rateLimiter = newRateLimiter()
+	p.mentionCache = newMentionCache()
 	p.router = p.initRouter()
 
 	p.commands = []SlashCommand{{
@@ -51,11 +54,57 @@ func (p *Plugin) OnActivate() error {
 	if err2 != nil {
 		return errors.Wrap(err2, "failed to store bot user ID")
 	}
-	return nil
+
+	if err := p.startOutbox(); err != nil {
+		return err
+	}
+	if err := p.startStandupReminders(); err != nil {
+		return err
+	}
+	if err := p.startMeetingSchedules(); err != nil {
+		return err
+	}
+	if err := p.startMembershipSync(); err != nil {
+		return err
+	}
+	if err := p.startUserSweep(); err != nil {
+		return err
+	}
+	return p.startChannelLinkCheck()
 }
 
 // OnDeactivate is invoked when the plugin is deactivated. This is the plugin's last chance to use
 // the API, and the plugin will be terminated shortly after this invocation.
 func (p *Plugin) OnDeactivate() error {
+	if p.outboxJob != nil {
+		if err := p.outboxJob.Close(); err != nil {
+			p.API.LogError("Failed to stop notification outbox", "err", err.Error())
+		}
+	}
+	if p.standupJob != nil {
+		if err := p.standupJob.Close(); err != nil {
+			p.API.LogError("Failed to stop standup reminders", "err", err.Error())
+		}
+	}
+	if p.meetingScheduleJob != nil {
+		if err := p.meetingScheduleJob.Close(); err != nil {
+			p.API.LogError("Failed to stop meeting schedules", "err", err.Error())
+		}
+	}
+	if p.membershipSyncJob != nil {
+		if err := p.membershipSyncJob.Close(); err != nil {
+			p.API.LogError("Failed to stop membership sync", "err", err.Error())
+		}
+	}
+	if p.userSweepJob != nil {
+		if err := p.userSweepJob.Close(); err != nil {
+			p.API.LogError("Failed to stop user sweep", "err", err.Error())
+		}
+	}
+	if p.channelLinkJob != nil {
+		if err := p.channelLinkJob.Close(); err != nil {
+			p.API.LogError("Failed to stop channel link check", "err", err.Error())
+		}
+	}
 	return nil
 }
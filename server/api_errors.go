@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// Stable error codes returned by the plugin routes. Clients should switch on these rather than
+// on the human readable message.
+const (
+	errCodeBadRequest       = "bad_request"
+	errCodeUnauthorized     = "unauthorized"
+	errCodeInvalidSignature = "invalid_signature"
+	errCodeForbidden        = "forbidden"
+	errCodeNoConnection     = "no_connection"
+	errCodeNotFound         = "not_found"
+	errCodeInternal         = "internal_error"
+	errCodeUpstream         = "upstream_error"
+	errCodeUpstreamTimeout  = "upstream_timeout"
+	errCodeRateLimited      = "rate_limited"
+	errCodeUnknownUser      = "unknown_user"
+	errCodeChannelArchived  = "channel_archived"
+	// errCodeInvalidNotification comes with a message describing the problem.
+	errCodeInvalidNotification = "invalid_notification"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// maxLoggedUpstreamBody bounds how much of an error response of Parabol is logged.
+const maxLoggedUpstreamBody = 1024
+
+type requestIDKey struct{}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// APIError is the body of every error response of the plugin routes.
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"error"`
+	RequestID string `json:"requestId,omitempty"`
+	// UpstreamStatus is the status code Parabol responded with, if any.
+	UpstreamStatus int `json:"upstreamStatus,omitempty"`
+}
+
+// withRequestID tags every request with an ID, taken from the X-Request-Id header if it is
+// well-formed, which is returned to the client and included in logs.
+func (p *Plugin) withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = model.NewId()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID)))
+	})
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// writeJSON writes v as JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError logs err, if any, and responds with an APIError. The underlying error is never sent
+// to the client as it may contain internal details.
+func (p *Plugin) writeError(w http.ResponseWriter, r *http.Request, statusCode int, code, message string, err error) {
+	requestID := requestIDFromContext(r.Context())
+	if err != nil {
+		logArgs := []any{"code", code, "status", statusCode, "path", r.URL.Path, "request_id", requestID, "err", err.Error()}
+		if statusCode >= http.StatusInternalServerError {
+			p.API.LogError(message, logArgs...)
+		} else {
+			p.API.LogWarn(message, logArgs...)
+		}
+	}
+	writeJSON(w, statusCode, APIError{
+		Code:      code,
+		Message:   message,
+		RequestID: requestID,
+	})
+}
+
+// writeUpstreamError responds to a failed request to Parabol, with 504 if it timed out and 502
+// otherwise.
+func (p *Plugin) writeUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		p.writeError(w, r, http.StatusGatewayTimeout, errCodeUpstreamTimeout, "Parabol did not respond in time", err)
+		return
+	}
+	p.writeError(w, r, http.StatusBadGateway, errCodeUpstream, "Failed to reach Parabol", err)
+}
+
+// writeUpstreamStatus forwards an unsuccessful response of Parabol to the client. Client errors
+// keep their status code, server errors become 502. The response body of Parabol is only
+// logged, it may contain internals not meant for browsers.
+func (p *Plugin) writeUpstreamStatus(w http.ResponseWriter, r *http.Request, statusCode int, body []byte) {
+	requestID := requestIDFromContext(r.Context())
+	if len(body) > maxLoggedUpstreamBody {
+		body = body[:maxLoggedUpstreamBody]
+	}
+	p.API.LogWarn("Parabol responded with an error", "status", statusCode, "path", r.URL.Path, "request_id", requestID, "body", string(body))
+	status := statusCode
+	if status >= http.StatusInternalServerError || status < http.StatusBadRequest {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, APIError{
+		Code:           errCodeUpstream,
+		Message:        "Parabol responded with an error",
+		RequestID:      requestID,
+		UpstreamStatus: statusCode,
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// auditLogSize bounds the number of audit records kept in KV, older records are overwritten.
+	auditLogSize    = 1000
+	auditHeadKey    = "audit_head"
+	auditSlotPrefix = "audit_"
+
+	auditDefaultLimit = 50
+	auditMaxLimit     = 500
+
+	auditOutcomeSuccess = "success"
+	auditOutcomeFailure = "failure"
+)
+
+// Audited actions.
+const (
+	auditActionNotifySignature = "notify.verify_signature"
+	auditActionConnect         = "commands.connect"
+	auditActionLogin           = "login"
+	auditActionConfiguration   = "configuration.change"
+	auditActionRotateStart     = "secret.rotate_start"
+	auditActionRotateFinish    = "secret.rotate_finish"
+	auditActionMembershipSync  = "membership.sync"
+	auditActionSyncMode        = "membership.sync_mode"
+	auditActionUserRemoved     = "user.remove"
+)
+
+// auditRecord is a security relevant action taken through the plugin.
+type auditRecord struct {
+	Seq       int64             `json:"seq"`
+	Timestamp int64             `json:"timestamp"`
+	ActorID   string            `json:"actorId,omitempty"`
+	Action    string            `json:"action"`
+	Target    string            `json:"target,omitempty"`
+	Outcome   string            `json:"outcome"`
+	SourceIP  string            `json:"sourceIp,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// auditFilter selects records when listing the audit log. Empty fields match everything.
+type auditFilter struct {
+	Action  string
+	ActorID string
+	Outcome string
+	Since   int64
+	Limit   int
+}
+
+func (f auditFilter) matches(record *auditRecord) bool {
+	return (f.Action == "" || strings.HasPrefix(record.Action, f.Action)) &&
+		(f.ActorID == "" || record.ActorID == f.ActorID) &&
+		(f.Outcome == "" || record.Outcome == f.Outcome) &&
+		record.Timestamp >= f.Since
+}
+
+// sourceIP returns the address of the client. Forwarding headers are only trusted if they are
+// configured in the TrustedProxyIPHeader setting of the server, and then only their last entry,
+// which was added by the proxy in front of Mattermost rather than by the client.
+func (p *Plugin) sourceIP(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	for _, header := range p.getConfiguration().trustedProxyHeaders {
+		values := strings.Split(r.Header.Get(header), ",")
+		if ip := net.ParseIP(strings.TrimSpace(values[len(values)-1])); ip != nil {
+			return ip.String()
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// nextSequence atomically increments the counter stored at key and returns its previous value.
+func (p *Plugin) nextSequence(key string) (int64, error) {
+	for range 10 {
+		raw, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return 0, errors.Wrap(appErr, "failed to read sequence")
+		}
+		var current int64
+		if raw != nil {
+			var err error
+			if current, err = strconv.ParseInt(string(raw), 10, 64); err != nil {
+				return 0, errors.Wrap(err, "invalid sequence")
+			}
+		}
+		ok, appErr := p.API.KVSetWithOptions(key, []byte(strconv.FormatInt(current+1, 10)), model.PluginKVSetOptions{
+			Atomic:   true,
+			OldValue: raw,
+		})
+		if appErr != nil {
+			return 0, errors.Wrap(appErr, "failed to update sequence")
+		}
+		if ok {
+			return current, nil
+		}
+	}
+	return 0, errors.New("too much contention updating sequence")
+}
+
+// audit records an action in the KV ring buffer and, if enabled, in the Mattermost audit log.
+// Failures to record are logged but don't fail the audited action.
+func (p *Plugin) audit(r *http.Request, record auditRecord) {
+	record.Timestamp = model.GetMillis()
+	if record.SourceIP == "" {
+		record.SourceIP = p.sourceIP(r)
+	}
+
+	if err := p.storeAuditRecord(&record); err != nil {
+		p.API.LogError("Failed to store audit record", "action", record.Action, "err", err.Error())
+	}
+
+	if p.getConfiguration().EnableMattermostAuditLog {
+		rec := &model.AuditRecord{
+			EventName: "parabol." + record.Action,
+			Status:    model.AuditStatusSuccess,
+			Actor: model.AuditEventActor{
+				UserId:    record.ActorID,
+				IpAddress: record.SourceIP,
+			},
+			Meta: map[string]any{"plugin_id": manifest.Id},
+		}
+		if record.Outcome != auditOutcomeSuccess {
+			rec.Fail()
+		}
+		model.AddEventParameterToAuditRec(rec, "target", record.Target)
+		if len(record.Details) > 0 {
+			model.AddEventParameterToAuditRec(rec, "details", record.Details)
+		}
+		if r != nil {
+			rec.Actor.XForwardedFor = r.Header.Get("X-Forwarded-For")
+			rec.AddMeta(model.AuditKeyAPIPath, r.URL.Path)
+		}
+		p.API.LogAuditRec(rec)
+	}
+}
+
+func (p *Plugin) storeAuditRecord(record *auditRecord) error {
+	seq, err := p.nextSequence(auditHeadKey)
+	if err != nil {
+		return err
+	}
+	record.Seq = seq
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize audit record")
+	}
+	if appErr := p.API.KVSet(auditSlotKey(seq), raw); appErr != nil {
+		return errors.Wrap(appErr, "failed to write audit record")
+	}
+	return nil
+}
+
+func auditSlotKey(seq int64) string {
+	return fmt.Sprintf("%s%04d", auditSlotPrefix, seq%auditLogSize)
+}
+
+// listAuditRecords returns the most recent records matching the filter, newest first.
+func (p *Plugin) listAuditRecords(filter auditFilter) ([]*auditRecord, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = auditDefaultLimit
+	}
+	if filter.Limit > auditMaxLimit {
+		filter.Limit = auditMaxLimit
+	}
+
+	raw, appErr := p.API.KVGet(auditHeadKey)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to read audit log")
+	}
+	records := []*auditRecord{}
+	if raw == nil {
+		return records, nil
+	}
+	head, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid audit log head")
+	}
+
+	for seq := head - 1; seq >= 0 && seq >= head-auditLogSize && len(records) < filter.Limit; seq-- {
+		raw, appErr := p.API.KVGet(auditSlotKey(seq))
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to read audit record")
+		}
+		if raw == nil {
+			continue
+		}
+		var record auditRecord
+		if err := json.Unmarshal(raw, &record); err != nil || record.Seq != seq {
+			continue
+		}
+		if record.Timestamp < filter.Since {
+			break
+		}
+		if filter.matches(&record) {
+			records = append(records, &record)
+		}
+	}
+	return records, nil
+}
+
+// getAuditLog lists audit records for system admins. Query parameters action, actor, outcome,
+// since (milliseconds) and limit filter the result.
+func (p *Plugin) getAuditLog(c *Context, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := auditFilter{
+		Action:  query.Get("action"),
+		ActorID: query.Get("actor"),
+		Outcome: query.Get("outcome"),
+	}
+	if since := query.Get("since"); since != "" {
+		value, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Invalid since parameter", err)
+			return
+		}
+		filter.Since = value
+	}
+	if limit := query.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Invalid limit parameter", err)
+			return
+		}
+		filter.Limit = value
+	}
+
+	records, err := p.listAuditRecords(filter)
+	if err != nil {
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Failed to read audit log", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// formatAuditRecords renders records as a Markdown table for `/parabol admin audit`.
+func (p *Plugin) formatAuditRecords(records []*auditRecord) string {
+	if len(records) == 0 {
+		return "No matching audit records."
+	}
+	var builder strings.Builder
+	builder.WriteString("| Time | Actor | Action | Target | Outcome | Source IP |\n|---|---|---|---|---|---|")
+	for _, record := range records {
+		actor := record.ActorID
+		if user, appErr := p.API.GetUser(record.ActorID); appErr == nil {
+			actor = "@" + user.Username
+		}
+		builder.WriteString(fmt.Sprintf("\n| %s | %s | %s | %s | %s | %s |",
+			time.UnixMilli(record.Timestamp).UTC().Format(time.RFC3339),
+			actor, record.Action, record.Target, record.Outcome, record.SourceIP))
+	}
+	return builder.String()
+}
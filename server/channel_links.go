@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+)
+
+const (
+	channelLinkPrefix   = "channel_link_"
+	channelLinkIndexKey = "link_index"
+	channelLinkJobKey   = "channel_link_job"
+
+	// channelLinkCheckInterval is how often linked channels are checked for being archived or
+	// restored, there are no hooks for either.
+	channelLinkCheckInterval = 5 * time.Minute
+	channelLinkTimeout       = 10 * time.Second
+)
+
+// Membership sync modes of a linked channel.
+const (
+	syncModeOff      = "off"
+	syncModeAuto     = "auto"
+	syncModeApproval = "approval"
+)
+
+// channelLink connects a channel to the Parabol team it receives notifications for. Parabol
+// registers the link when a channel is picked in its integration settings.
+type channelLink struct {
+	ChannelID     string `json:"channelId"`
+	ParabolTeamID string `json:"parabolTeamId"`
+	TeamName      string `json:"teamName,omitempty"`
+	Connection    string `json:"connection"`
+	LinkedAt      int64  `json:"linkedAt"`
+	// SyncMode controls whether channel membership is mirrored to the Parabol team.
+	SyncMode string `json:"syncMode,omitempty"`
+	// Paused is set while the channel is archived, Parabol was asked to stop sending to it.
+	Paused bool `json:"paused,omitempty"`
+}
+
+// channelLinkState tells Parabol that a linked channel was archived or restored.
+type channelLinkState struct {
+	ChannelID     string `json:"channelId"`
+	ParabolTeamID string `json:"parabolTeamId"`
+	Paused        bool   `json:"paused"`
+}
+
+func (p *Plugin) getChannelLink(channelID string) (*channelLink, error) {
+	raw, appErr := p.API.KVGet(channelLinkPrefix + channelID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to read channel link")
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	var link channelLink
+	if err := json.Unmarshal(raw, &link); err != nil {
+		return nil, errors.Wrap(err, "invalid channel link")
+	}
+	return &link, nil
+}
+
+func (p *Plugin) saveChannelLink(link *channelLink) error {
+	raw, err := json.Marshal(link)
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize channel link")
+	}
+	if appErr := p.API.KVSet(channelLinkPrefix+link.ChannelID, raw); appErr != nil {
+		return errors.Wrap(appErr, "failed to store channel link")
+	}
+	return p.addToIndex(channelLinkIndexKey, channelLinkPrefix, link.ChannelID)
+}
+
+// updateChannelLink applies update to the stored link of the channel, retrying if it was changed
+// concurrently. It returns false without calling update if the channel was unlinked.
+func (p *Plugin) updateChannelLink(channelID string, update func(link *channelLink)) (bool, error) {
+	for range 10 {
+		raw, appErr := p.API.KVGet(channelLinkPrefix + channelID)
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "failed to read channel link")
+		}
+		if raw == nil {
+			return false, nil
+		}
+		var link channelLink
+		if err := json.Unmarshal(raw, &link); err != nil {
+			return false, errors.Wrap(err, "invalid channel link")
+		}
+		update(&link)
+		updated, err := json.Marshal(&link)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to serialize channel link")
+		}
+		ok, appErr := p.API.KVSetWithOptions(channelLinkPrefix+channelID, updated, model.PluginKVSetOptions{Atomic: true, OldValue: raw})
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "failed to store channel link")
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, errors.New("too much contention updating channel link")
+}
+
+// deleteChannelLink removes the link of the channel along with its pending membership changes.
+func (p *Plugin) deleteChannelLink(channelID string) error {
+	if appErr := p.API.KVDelete(channelLinkPrefix + channelID); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete channel link")
+	}
+	if appErr := p.API.KVDelete(syncPendingPrefix + channelID); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete pending changes")
+	}
+	return p.removeFromIndex(channelLinkIndexKey, channelLinkPrefix, channelID)
+}
+
+func (p *Plugin) listChannelLinks() ([]*channelLink, error) {
+	channelIDs, err := p.readIndex(channelLinkIndexKey, channelLinkPrefix)
+	if err != nil {
+		return nil, err
+	}
+	links := make([]*channelLink, 0, len(channelIDs))
+	for _, channelID := range channelIDs {
+		link, err := p.getChannelLink(channelID)
+		if err != nil {
+			p.API.LogWarn("Skipping invalid channel link", "channel_id", channelID, "err", err.Error())
+			continue
+		}
+		if link == nil {
+			if err := p.removeFromIndex(channelLinkIndexKey, channelLinkPrefix, channelID); err != nil {
+				p.API.LogWarn("Failed to remove channel link from the index", "channel_id", channelID, "err", err.Error())
+			}
+			continue
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// linkChannel is called by Parabol to link a channel to a Parabol team, or with DELETE to unlink
+// it. Settings like the sync mode are kept when a link is updated.
+func (p *Plugin) linkChannel(w http.ResponseWriter, r *http.Request) {
+	channelID := mux.Vars(r)["channelID"]
+	connection := p.verifyChannelNotification(w, r, channelID)
+	if connection == nil {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := p.deleteChannelLink(channelID); err != nil {
+			p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error deleting link", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var body struct {
+		ParabolTeamID string `json:"parabolTeamId"`
+		TeamName      string `json:"teamName"`
+	}
+	if err := getJSON(r.Body, &body); err != nil || body.ParabolTeamID == "" {
+		p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "parabolTeamId is required", err)
+		return
+	}
+	link, err := p.getChannelLink(channelID)
+	if err != nil {
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error reading link", err)
+		return
+	}
+	if link == nil {
+		link = &channelLink{ChannelID: channelID, SyncMode: syncModeOff}
+	}
+	link.ParabolTeamID = body.ParabolTeamID
+	link.TeamName = body.TeamName
+	link.Connection = connection.Name
+	link.LinkedAt = model.GetMillis()
+	if err := p.saveChannelLink(link); err != nil {
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error storing link", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, link)
+}
+
+// setChannelLinkPaused pauses the link of an archived channel or resumes it once restored, and
+// tells Parabol with a signed call. The link only changes once Parabol accepted the call, so a
+// failed call is repeated the next time the state is detected.
+func (p *Plugin) setChannelLinkPaused(channelID string, paused bool) {
+	link, err := p.getChannelLink(channelID)
+	if err != nil {
+		p.API.LogError("Failed to read channel link", "channel_id", channelID, "err", err.Error())
+		return
+	}
+	if link == nil || link.Paused == paused {
+		return
+	}
+	connection := p.getConfiguration().connectionByName(link.Connection)
+	if connection == nil {
+		p.API.LogWarn("No Parabol connection for channel link", "channel_id", channelID, "connection", link.Connection)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), channelLinkTimeout)
+	defer cancel()
+	if err := p.callParabol(ctx, connection, "/mattermost/channel/state", &channelLinkState{
+		ChannelID:     channelID,
+		ParabolTeamID: link.ParabolTeamID,
+		Paused:        paused,
+	}, nil); err != nil {
+		p.API.LogWarn("Failed to update channel link in Parabol", "channel_id", channelID, "paused", paused, "err", err.Error())
+		return
+	}
+	// The link is read again, so it isn't recreated if the channel was unlinked meanwhile.
+	found, err := p.updateChannelLink(channelID, func(stored *channelLink) {
+		stored.Paused = paused
+	})
+	if err != nil {
+		p.API.LogError("Failed to store channel link", "channel_id", channelID, "err", err.Error())
+		return
+	}
+	if !found {
+		return
+	}
+	p.API.LogInfo("Updated channel link", "channel_id", channelID, "paused", paused)
+}
+
+// channelArchived reports whether the channel is archived. The link of an archived channel is
+// paused in the background.
+func (p *Plugin) channelArchived(channelID string) bool {
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil || channel.DeleteAt == 0 {
+		return false
+	}
+	go p.setChannelLinkPaused(channelID, true)
+	return true
+}
+
+// startChannelLinkCheck schedules the cluster wide job pausing and resuming the links of archived
+// and restored channels.
+func (p *Plugin) startChannelLinkCheck() error {
+	job, err := cluster.Schedule(p.API, channelLinkJobKey, cluster.MakeWaitForInterval(channelLinkCheckInterval), p.checkChannelLinks)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule channel link check")
+	}
+	p.channelLinkJob = job
+	return nil
+}
+
+func (p *Plugin) checkChannelLinks() {
+	links, err := p.listChannelLinks()
+	if err != nil {
+		p.API.LogError("Failed to read channel links", "err", err.Error())
+		return
+	}
+	for _, link := range links {
+		channel, appErr := p.API.GetChannel(link.ChannelID)
+		if appErr != nil {
+			p.API.LogWarn("Failed to check linked channel", "channel_id", link.ChannelID, "err", appErr.Error())
+			continue
+		}
+		if archived := channel.DeleteAt != 0; archived != link.Paused {
+			p.setChannelLinkPaused(link.ChannelID, archived)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkChannel(t *testing.T) {
+	const otherToken = "7e2a9c4f1b8d3e6a0c5f2b9d4e7a1c8f3b6d0e5a2c9f4b7e1d8a3c6f0b5e2d9a"
+	teamID, otherTeamID := model.NewId(), model.NewId()
+	channelID := model.NewId()
+
+	for name, tc := range map[string]struct {
+		method       string
+		body         string
+		signingToken string
+		stored       *channelLink
+		expectStatus int
+		expectLink   *channelLink
+	}{
+		"unsigned": {
+			method:       http.MethodPut,
+			body:         `{"parabolTeamId": "t1"}`,
+			expectStatus: http.StatusUnauthorized,
+		},
+		"signed by another connection": {
+			method:       http.MethodPut,
+			body:         `{"parabolTeamId": "t1"}`,
+			signingToken: otherToken,
+			expectStatus: http.StatusNotFound,
+		},
+		"missing team": {
+			method:       http.MethodPut,
+			body:         `{"teamName": "Engineering"}`,
+			signingToken: testToken,
+			expectStatus: http.StatusBadRequest,
+		},
+		"new link": {
+			method:       http.MethodPut,
+			body:         `{"parabolTeamId": "t1", "teamName": "Engineering"}`,
+			signingToken: testToken,
+			expectStatus: http.StatusOK,
+			expectLink:   &channelLink{ChannelID: channelID, ParabolTeamID: "t1", TeamName: "Engineering", Connection: "default", SyncMode: syncModeOff},
+		},
+		"updated link keeps its settings": {
+			method:       http.MethodPut,
+			body:         `{"parabolTeamId": "t2", "teamName": "Design"}`,
+			signingToken: testToken,
+			stored:       &channelLink{ChannelID: channelID, ParabolTeamID: "t1", Connection: "default", SyncMode: syncModeApproval, Paused: true},
+			expectStatus: http.StatusOK,
+			expectLink:   &channelLink{ChannelID: channelID, ParabolTeamID: "t2", TeamName: "Design", Connection: "default", SyncMode: syncModeApproval, Paused: true},
+		},
+		"unlink": {
+			method:       http.MethodDelete,
+			signingToken: testToken,
+			stored:       &channelLink{ChannelID: channelID, ParabolTeamID: "t1", Connection: "default", SyncMode: syncModeApproval},
+			expectStatus: http.StatusNoContent,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := newTestAPI()
+			api.channels[channelID] = &model.Channel{Id: channelID, TeamId: teamID}
+			p := newTestPlugin(api)
+			p.setConfiguration(&configuration{connections: []*parabolConnection{
+				{Name: "default", URL: "https://parabol.test", Token: testToken, Teams: []string{teamID}},
+				{Name: "other", URL: "https://other.parabol.test", Token: otherToken, Teams: []string{otherTeamID}},
+			}})
+			if tc.stored != nil {
+				require.NoError(t, p.saveChannelLink(tc.stored))
+				_, err := p.updatePendingSync(channelID, func(pending *pendingSync) {
+					pending.Changes["alice@example.com"] = membershipChange{Email: "alice@example.com", UserID: "alice", Action: syncActionInvite}
+				})
+				require.NoError(t, err)
+			}
+
+			url := "http://mattermost.test/plugins/co.parabol.action/links/" + channelID
+			var req *http.Request
+			if tc.signingToken == "" {
+				req = httptest.NewRequest(tc.method, url, strings.NewReader(tc.body))
+			} else {
+				signer, err := NewSigner(algHS256, []byte(tc.signingToken), "")
+				require.NoError(t, err)
+				req = signRequestAsParabol(t, signer, tc.method, url, []byte(tc.body))
+			}
+			req = mux.SetURLVars(req, map[string]string{"channelID": channelID})
+			w := httptest.NewRecorder()
+			p.linkChannel(w, req)
+
+			require.Equal(t, tc.expectStatus, w.Code, w.Body.String())
+			link, err := p.getChannelLink(channelID)
+			require.NoError(t, err)
+			switch {
+			case tc.expectLink != nil:
+				require.NotNil(t, link)
+				assert.NotZero(t, link.LinkedAt)
+				link.LinkedAt = 0
+				assert.Equal(t, tc.expectLink, link)
+				var response channelLink
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+				assert.Equal(t, tc.expectLink.ParabolTeamID, response.ParabolTeamID)
+			case tc.method == http.MethodDelete && tc.expectStatus == http.StatusNoContent:
+				assert.Nil(t, link)
+				pending, err := p.getPendingSync(channelID)
+				require.NoError(t, err)
+				assert.Nil(t, pending, "pending changes are removed with the link")
+				links, err := p.listChannelLinks()
+				require.NoError(t, err)
+				assert.Empty(t, links)
+			default:
+				assert.Equal(t, tc.stored, link)
+			}
+		})
+	}
+}
+
+func TestCheckChannelLinks(t *testing.T) {
+	for name, tc := range map[string]struct {
+		archived     bool
+		paused       bool
+		status       int
+		expectCalled bool
+		expectPaused bool
+	}{
+		"active channel": {
+			status: http.StatusOK,
+		},
+		"archived channel is paused": {
+			archived:     true,
+			status:       http.StatusOK,
+			expectCalled: true,
+			expectPaused: true,
+		},
+		"restored channel is resumed": {
+			paused:       true,
+			status:       http.StatusOK,
+			expectCalled: true,
+		},
+		"link is unchanged when Parabol fails": {
+			archived:     true,
+			status:       http.StatusBadGateway,
+			expectCalled: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var requests []channelLinkState
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/mattermost/channel/state", r.URL.Path)
+				var request channelLinkState
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+				requests = append(requests, request)
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			api := newTestAPI()
+			channel := &model.Channel{Id: model.NewId()}
+			if tc.archived {
+				channel.DeleteAt = model.GetMillis()
+			}
+			api.channels[channel.Id] = channel
+			p := newTestPlugin(api)
+			p.setConfiguration(&configuration{connections: []*parabolConnection{
+				{Name: "default", URL: server.URL, Token: testToken},
+			}})
+			require.NoError(t, p.saveChannelLink(&channelLink{ChannelID: channel.Id, ParabolTeamID: "t1", Connection: "default", Paused: tc.paused}))
+
+			p.checkChannelLinks()
+
+			if tc.expectCalled {
+				assert.Equal(t, []channelLinkState{{ChannelID: channel.Id, ParabolTeamID: "t1", Paused: tc.archived}}, requests)
+			} else {
+				assert.Empty(t, requests)
+			}
+			link, err := p.getChannelLink(channel.Id)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectPaused, link.Paused)
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+const (
+	adminHelpText = "###### Parabol Admin Commands\n" +
+		"- `/parabol admin rotate start [connection]` - Generate a new secret, keeping the current one as secondary\n" +
+		"- `/parabol admin rotate finish [connection]` - Stop accepting the secondary secret\n" +
+		"- `/parabol admin rotate status` - Show which connections are being rotated\n" +
+		"- `/parabol admin audit [action=...] [actor=@username] [outcome=success|failure] [limit=N]` - Show recent audit records\n" +
+		"- `/parabol admin outbox` - Show queued and undeliverable notifications\n" +
+		"- `/parabol admin outbox retry <id|all>` - Queue undeliverable notifications again"
+
+	// generatedTokenBytes is the amount of randomness in a generated secret, hex encoded it is
+	// twice as long.
+	generatedTokenBytes = 32
+)
+
+func ephemeralResponse(text string) *model.CommandResponse {
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+	}
+}
+
+// executeAdminCommand handles `/parabol admin ...`, which is restricted to system admins.
+func (p *Plugin) executeAdminCommand(args *model.CommandArgs, fields []string) *model.CommandResponse {
+	if !p.API.HasPermissionTo(args.UserId, model.PermissionManageSystem) {
+		return ephemeralResponse("Only system admins can run Parabol admin commands.")
+	}
+	if len(fields) == 0 {
+		return ephemeralResponse(adminHelpText)
+	}
+
+	switch fields[0] {
+	case "rotate":
+		return p.executeRotateCommand(args, fields[1:])
+	case "audit":
+		return p.executeAuditCommand(fields[1:])
+	case "outbox":
+		return p.executeOutboxCommand(fields[1:])
+	default:
+		return ephemeralResponse(adminHelpText)
+	}
+}
+
+func (p *Plugin) executeRotateCommand(args *model.CommandArgs, fields []string) *model.CommandResponse {
+	if len(fields) == 0 {
+		return ephemeralResponse(adminHelpText)
+	}
+	name := defaultConnectionName
+	if len(fields) >= 2 {
+		name = fields[1]
+	}
+
+	switch fields[0] {
+	case "status":
+		var builder strings.Builder
+		builder.WriteString("###### Parabol Secret Rotation")
+		for _, connection := range p.getConfiguration().connections {
+			state := "primary secret only"
+			if connection.SecondaryToken != "" {
+				state = "rotation in progress, secondary secret still accepted"
+			}
+			builder.WriteString(fmt.Sprintf("\n- `%s`: %s", connection.Name, state))
+		}
+		return ephemeralResponse(builder.String())
+
+	case "start":
+		// The secret is shown in a dialog, so it doesn't end up in a post.
+		token, err := generateToken()
+		if err != nil {
+			p.API.LogError("Failed to generate Parabol secret", "err", err.Error())
+			return ephemeralResponse("Failed to generate a new secret.")
+		}
+		if connection := p.getConfiguration().connectionByName(name); connection == nil {
+			return ephemeralResponse(fmt.Sprintf("Unknown connection `%s`.", name))
+		}
+		if appErr := p.API.OpenInteractiveDialog(rotateDialog(args.TriggerId, name, token)); appErr != nil {
+			p.API.LogError("Failed to open the rotation dialog", "err", appErr.Error())
+			return ephemeralResponse("Failed to open the rotation dialog.")
+		}
+		return &model.CommandResponse{}
+
+	case "finish":
+		err := p.updateConnection(name, func(connection *parabolConnection) error {
+			if connection.SecondaryToken == "" {
+				return errors.New("no rotation is in progress")
+			}
+			connection.SecondaryToken = ""
+			return nil
+		})
+		rotateAudit := auditRecord{ActorID: args.UserId, Action: auditActionRotateFinish, Target: name, Outcome: auditOutcomeSuccess}
+		if err != nil {
+			rotateAudit.Outcome = auditOutcomeFailure
+			p.audit(nil, rotateAudit)
+			return ephemeralResponse(fmt.Sprintf("Failed to finish the rotation of `%s`: %s", name, err))
+		}
+		p.audit(nil, rotateAudit)
+		p.API.LogInfo("Parabol secret rotation finished", "connection", name)
+		return ephemeralResponse(fmt.Sprintf("The previous secret of `%s` is no longer accepted.", name))
+
+	default:
+		return ephemeralResponse(adminHelpText)
+	}
+}
+
+// rotateDialog asks the admin to configure the new secret of the connection in Parabol before the
+// rotation is started. The generated secret may be replaced by one of the admin's own.
+func rotateDialog(triggerID, name, token string) model.OpenDialogRequest {
+	return model.OpenDialogRequest{
+		TriggerId: triggerID,
+		URL:       fmt.Sprintf("/plugins/%s/admin/rotate", manifest.Id),
+		Dialog: model.Dialog{
+			CallbackId: "rotate",
+			Title:      "Rotate Parabol Secret",
+			IntroductionText: fmt.Sprintf("Configure the new secret of `%s` in Parabol. It isn't shown again. "+
+				"The previous secret is accepted until you run `/parabol admin rotate finish %s`.", name, name),
+			Elements: []model.DialogElement{{
+				DisplayName: "New secret",
+				Name:        "secret",
+				Type:        "text",
+				Default:     token,
+				HelpText:    "Generated for you, or paste a secret of your own.",
+			}},
+			SubmitLabel: "Start rotation",
+			State:       name,
+		},
+	}
+}
+
+// submitRotation starts the rotation of the connection named in the dialog's state with the
+// submitted secret. Only the outcome is posted, never the secret.
+func (p *Plugin) submitRotation(c *Context, w http.ResponseWriter, r *http.Request) {
+	var request model.SubmitDialogRequest
+	if err := getJSON(r.Body, &request); err != nil {
+		p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Error parsing body", err)
+		return
+	}
+	if request.Cancelled {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	name := request.State
+	token, _ := request.Submission["secret"].(string)
+	if err := validateToken(token); err != nil {
+		writeJSON(w, http.StatusOK, model.SubmitDialogResponse{Errors: map[string]string{"secret": err.Error()}})
+		return
+	}
+	if err := checkTokenStrength(token); err != nil {
+		writeJSON(w, http.StatusOK, model.SubmitDialogResponse{Errors: map[string]string{"secret": err.Error()}})
+		return
+	}
+
+	err := p.updateConnection(name, func(connection *parabolConnection) error {
+		if !connection.isSharedSecret() {
+			return errors.New("only HS256 shared secrets can be rotated, replace the key pair instead")
+		}
+		if connection.SecondaryToken != "" {
+			return errors.New("a rotation is already in progress, finish it first")
+		}
+		connection.SecondaryToken = connection.Token
+		connection.Token = token
+		return nil
+	})
+	rotateAudit := auditRecord{ActorID: c.UserID, Action: auditActionRotateStart, Target: name, Outcome: auditOutcomeSuccess}
+	if err != nil {
+		rotateAudit.Outcome = auditOutcomeFailure
+		p.audit(r, rotateAudit)
+		writeJSON(w, http.StatusOK, model.SubmitDialogResponse{Error: fmt.Sprintf("Failed to rotate the secret of %s: %s", name, err)})
+		return
+	}
+	p.audit(r, rotateAudit)
+	p.API.LogWarn("Parabol secret rotation started", "connection", name)
+	if botID, appErr := p.API.KVGet(botUserID); appErr == nil {
+		p.API.SendEphemeralPost(c.UserID, &model.Post{
+			ChannelId: request.ChannelId,
+			UserId:    string(botID),
+			Message: fmt.Sprintf("The secret of `%s` was rotated, the previous secret is accepted until you run "+
+				"`/parabol admin rotate finish %s`.", name, name),
+		})
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// executeAuditCommand lists recent audit records, filtered by key=value arguments.
+func (p *Plugin) executeAuditCommand(fields []string) *model.CommandResponse {
+	filter := auditFilter{Limit: 20}
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return ephemeralResponse(adminHelpText)
+		}
+		switch key {
+		case "action":
+			filter.Action = value
+		case "actor":
+			user, appErr := p.API.GetUserByUsername(strings.TrimPrefix(value, "@"))
+			if appErr != nil {
+				return ephemeralResponse(fmt.Sprintf("Unknown user `%s`.", value))
+			}
+			filter.ActorID = user.Id
+		case "outcome":
+			filter.Outcome = value
+		case "limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil {
+				return ephemeralResponse(fmt.Sprintf("Invalid limit `%s`.", value))
+			}
+			filter.Limit = limit
+		default:
+			return ephemeralResponse(adminHelpText)
+		}
+	}
+
+	records, err := p.listAuditRecords(filter)
+	if err != nil {
+		p.API.LogError("Failed to read audit log", "err", err.Error())
+		return ephemeralResponse("Failed to read the audit log.")
+	}
+	return ephemeralResponse("###### Parabol Audit Log\n" + p.formatAuditRecords(records))
+}
+
+// executeOutboxCommand shows the notification outbox or retries dead letters.
+func (p *Plugin) executeOutboxCommand(fields []string) *model.CommandResponse {
+	if len(fields) == 2 && fields[0] == "retry" {
+		retried, err := p.retryDeadLetters(fields[1])
+		if err != nil {
+			p.API.LogError("Failed to retry notifications", "err", err.Error())
+			return ephemeralResponse(fmt.Sprintf("Failed to retry notifications, %d were queued again.", retried))
+		}
+		return ephemeralResponse(fmt.Sprintf("Queued %d notifications again.", retried))
+	}
+	if len(fields) != 0 {
+		return ephemeralResponse(adminHelpText)
+	}
+
+	state, err := p.getOutboxState()
+	if err != nil {
+		p.API.LogError("Failed to read notification outbox", "err", err.Error())
+		return ephemeralResponse("Failed to read the notification outbox.")
+	}
+	return ephemeralResponse(formatOutboxState(state))
+}
+
+// generateToken returns a new random secret suitable for validateToken.
+func generateToken() (string, error) {
+	raw := make([]byte, generatedTokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// updateConnection applies update to the named connection and persists the plugin configuration.
+// Team names are kept as configured, secrets are stored encrypted.
+func (p *Plugin) updateConnection(name string, update func(connection *parabolConnection) error) error {
+	config := p.getConfiguration()
+	connections, err := parseConnections(config)
+	if err != nil {
+		return err
+	}
+
+	var target *parabolConnection
+	additional := make([]*parabolConnection, 0, len(connections))
+	for _, connection := range connections {
+		if connection.Name == name {
+			target = connection
+		}
+		if connection.Name != defaultConnectionName {
+			additional = append(additional, connection)
+		}
+	}
+	if target == nil {
+		return errors.Errorf("unknown connection %q", name)
+	}
+	if _, err := p.resolveSecrets([]*parabolConnection{target}); err != nil {
+		return err
+	}
+	if err := update(target); err != nil {
+		return err
+	}
+	return p.saveWithSecrets([]*parabolConnection{target}, func() (map[string]any, error) {
+		if name == defaultConnectionName {
+			return map[string]any{
+				"ParabolToken":          target.Token,
+				"ParabolSecondaryToken": target.SecondaryToken,
+				"PrivateKey":            target.PrivateKey,
+			}, nil
+		}
+		raw, err := json.Marshal(additional)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to serialize connections")
+		}
+		return map[string]any{"Connections": string(raw)}, nil
+	})
+}
+
+// savePluginSettings merges updates into the persisted plugin configuration. The server may
+// store keys in lower case, so existing keys are matched case-insensitively.
+func (p *Plugin) savePluginSettings(updates map[string]any) error {
+	settings := p.API.GetPluginConfig()
+	if settings == nil {
+		settings = map[string]any{}
+	}
+	for key, value := range updates {
+		for existing := range settings {
+			if strings.EqualFold(existing, key) {
+				delete(settings, existing)
+			}
+		}
+		settings[key] = value
+	}
+	if appErr := p.API.SavePluginConfig(settings); appErr != nil {
+		return errors.Wrap(appErr, "failed to save plugin configuration")
+	}
+	return nil
+}
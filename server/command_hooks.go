@@ -16,6 +16,43 @@ const (
 	commandHelpTitle   = "###### Parabol Slash Command Help"
 )
 
+// builtinAutocompleteData describes the commands handled by the plugin itself, in addition to the
+// commands registered by Parabol through /connect. It is used for the help message, too.
+func builtinAutocompleteData() []*model.AutocompleteData {
+	standup := model.NewAutocompleteData("standup", "", "Schedule standup reminders in this channel")
+	standup.AddCommand(model.NewAutocompleteData("set", "<HH:MM> <mon,tue,...|weekdays|daily> [time zone]", "Remind the channel of its standup"))
+	standup.AddCommand(model.NewAutocompleteData("show", "", "Show the standup schedule of this channel"))
+	standup.AddCommand(model.NewAutocompleteData("remove", "", "Stop the standup reminders of this channel"))
+
+	schedule := model.NewAutocompleteData("schedule", "", "Start Parabol meetings on a recurring schedule in this channel")
+	schedule.AddCommand(model.NewAutocompleteData("add", "<retro|checkin|poker|standup> <FREQ=WEEKLY;INTERVAL=2;BYDAY=FR;BYHOUR=15> [time zone]", "Schedule a recurring meeting"))
+	schedule.AddCommand(model.NewAutocompleteData("list", "", "Show the meeting schedules of this channel"))
+	schedule.AddCommand(model.NewAutocompleteData("pause", "<id>", "Stop starting meetings until resumed"))
+	schedule.AddCommand(model.NewAutocompleteData("resume", "<id>", "Start meetings again, missed runs are skipped"))
+	schedule.AddCommand(model.NewAutocompleteData("delete", "<id>", "Delete a meeting schedule"))
+
+	sync := model.NewAutocompleteData("sync", "", "Mirror the members of this channel to its linked Parabol team")
+	sync.AddCommand(model.NewAutocompleteData("status", "", "Show the sync mode and the changes waiting for approval"))
+	sync.AddCommand(model.NewAutocompleteData("mode", "<off|auto|approval>", "Choose how membership changes are applied"))
+	sync.AddCommand(model.NewAutocompleteData("dry-run", "", "Show the changes a sync would make"))
+	sync.AddCommand(model.NewAutocompleteData("approve", "<email|all>", "Apply changes waiting for approval"))
+	sync.AddCommand(model.NewAutocompleteData("reject", "<email|all>", "Discard changes waiting for approval"))
+
+	mentions := model.NewAutocompleteData("mentions", "", "Choose whether Parabol notifications @mention you")
+	mentions.AddCommand(model.NewAutocompleteData("off", "", "Show your name instead of a mention"))
+	mentions.AddCommand(model.NewAutocompleteData("on", "", "Mention you again"))
+
+	return []*model.AutocompleteData{
+		model.NewAutocompleteData("mute", "", "Stop direct messages from Parabol"),
+		model.NewAutocompleteData("unmute", "", "Receive direct messages from Parabol again"),
+		model.NewAutocompleteData("reflect", "<text>", "Add an anonymous reflection to your team's upcoming retrospective"),
+		mentions,
+		standup,
+		schedule,
+		sync,
+	}
+}
+
 func (p *Plugin) registerCommands() error {
 	if err := p.API.RegisterCommand(&model.Command{
 		Trigger:          commandTrigger,
@@ -39,8 +76,24 @@ func (p *Plugin) getCommandDialogAutocompleteData() *model.AutocompleteData {
 		}
 	}
 
+	for _, builtin := range builtinAutocompleteData() {
+		command.AddCommand(builtin)
+	}
 	command.AddCommand(model.NewAutocompleteData("help", "", "Show help message"))
 
+	admin := model.NewAutocompleteData("admin", "", "Administer the Parabol plugin")
+	admin.RoleID = model.SystemAdminRoleId
+	rotate := model.NewAutocompleteData("rotate", "", "Rotate the secret shared with Parabol")
+	rotate.AddCommand(model.NewAutocompleteData("start", "[connection]", "Generate a new secret, keeping the current one as secondary"))
+	rotate.AddCommand(model.NewAutocompleteData("finish", "[connection]", "Stop accepting the secondary secret"))
+	rotate.AddCommand(model.NewAutocompleteData("status", "", "Show which connections are being rotated"))
+	admin.AddCommand(rotate)
+	admin.AddCommand(model.NewAutocompleteData("audit", "[action=...] [actor=@username] [outcome=success|failure] [limit=N]", "Show recent audit records"))
+	outbox := model.NewAutocompleteData("outbox", "", "Show queued and undeliverable notifications")
+	outbox.AddCommand(model.NewAutocompleteData("retry", "<id|all>", "Queue undeliverable notifications again"))
+	admin.AddCommand(outbox)
+	command.AddCommand(admin)
+
 	return command
 }
 
@@ -58,12 +111,33 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 	}
 }
 
+// commandLabel returns the metric label of a subcommand. Anything which isn't a known command is
+// counted as unknown, so typos don't create new label values.
+func (p *Plugin) commandLabel(command string) string {
+	switch command {
+	case "", "help", "check", "admin", "dialog":
+		return command
+	}
+	for _, builtin := range builtinAutocompleteData() {
+		if builtin.Trigger == command {
+			return command
+		}
+	}
+	for _, commandDef := range p.commands {
+		if commandDef.Trigger == command {
+			return command
+		}
+	}
+	return "unknown"
+}
+
 func (p *Plugin) executeCommand(args *model.CommandArgs) *model.CommandResponse {
 	fields := strings.Fields(args.Command)
 	command := ""
 	if len(fields) >= 2 {
 		command = fields[1]
 	}
+	p.metrics.inc(metricCommandInvocations, p.commandLabel(command))
 
 	switch command {
 	case "help":
@@ -76,13 +150,23 @@ func (p *Plugin) executeCommand(args *model.CommandArgs) *model.CommandResponse
 				helpTextBuilder.WriteString(fmt.Sprintf("\n- `/%s %s` - %s", commandTrigger, commandDef.Trigger, commandDef.Description))
 			}
 		}
+		for _, builtin := range builtinAutocompleteData() {
+			helpTextBuilder.WriteString(fmt.Sprintf("\n- `/%s %s` - %s", commandTrigger, builtin.Trigger, builtin.HelpText))
+		}
 
 		return &model.CommandResponse{
 			ResponseType: model.CommandResponseTypeEphemeral,
 			Text:         helpTextBuilder.String(),
 		}
 	case "check":
-		if err := p.checkConnection(); err != nil {
+		connection, err := p.getConfiguration().connectionForTeam(args.TeamId)
+		if err != nil {
+			return &model.CommandResponse{
+				ResponseType: model.CommandResponseTypeEphemeral,
+				Text:         "No Parabol instance is configured for this team.",
+			}
+		}
+		if err := p.checkConnection(connection); err != nil {
 			return &model.CommandResponse{
 				ResponseType: model.CommandResponseTypeEphemeral,
 				Text:         fmt.Sprintf("Failed to connect to Parabol, check the configuration (%s)", err),
@@ -92,6 +176,37 @@ func (p *Plugin) executeCommand(args *model.CommandArgs) *model.CommandResponse
 			ResponseType: model.CommandResponseTypeEphemeral,
 			Text:         "Successfully connected to Parabol",
 		}
+	case "mute", "unmute":
+		if err := p.setMuted(args.UserId, command == "mute"); err != nil {
+			p.API.LogError("Failed to store mute preference", "user_id", args.UserId, "err", err.Error())
+			return ephemeralResponse("Failed to update your preference.")
+		}
+		if command == "mute" {
+			return ephemeralResponse("You won't receive direct messages from Parabol anymore. Run `/parabol unmute` to undo.")
+		}
+		return ephemeralResponse("You will receive direct messages from Parabol again.")
+	case "reflect":
+		return p.executeReflectCommand(args)
+	case "mentions":
+		if len(fields) != 3 || (fields[2] != "on" && fields[2] != "off") {
+			return ephemeralResponse("Usage: `/parabol mentions on|off`")
+		}
+		if err := p.setMentionOptOut(args.UserId, fields[2] == "off"); err != nil {
+			p.API.LogError("Failed to store mention preference", "user_id", args.UserId, "err", err.Error())
+			return ephemeralResponse("Failed to update your preference.")
+		}
+		if fields[2] == "off" {
+			return ephemeralResponse("Parabol notifications will show your name instead of mentioning you. Run `/parabol mentions on` to undo.")
+		}
+		return ephemeralResponse("Parabol notifications will mention you again.")
+	case "standup":
+		return p.executeStandupCommand(args, fields[2:])
+	case "schedule":
+		return p.executeScheduleCommand(args, fields[2:])
+	case "sync":
+		return p.executeSyncCommand(args, fields[2:])
+	case "admin":
+		return p.executeAdminCommand(args, fields[2:])
 	// this case is left here for development, so it's easy to copy the styles
 	case "dialog":
 		dialogRequest := model.OpenDialogRequest{
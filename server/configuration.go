@@ -1,12 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
 	"net/http"
+	"net/url"
+	"reflect"
 	"strings"
+	"time"
 
+	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/pkg/errors"
+	"github.com/yaronf/httpsign"
 )
 
+const (
+	// minTokenLength and minTokenEntropy are the lower bounds for the shared secret, a random UUID
+	// clears both comfortably.
+	minTokenLength  = 32
+	minTokenEntropy = 96.0
+
+	handshakeTimeout = 10 * time.Second
+)
+
+var errSignatureRejected = errors.New("Parabol rejected the signature, check the Parabol API Token")
+
 // configuration captures the plugin's external configuration as exposed in the Mattermost server
 // configuration, as well as values computed from the configuration. Any public fields will be
 // deserialized from the Mattermost server configuration in OnConfigurationChange.
@@ -25,6 +45,48 @@ type configuration struct {
 
 	// WebhookSecret is the secret used to validate incoming webhooks.
 	ParabolToken string
+
+	// ParabolSecondaryToken is the previous secret, accepted for incoming notifications until a
+	// rotation is finished.
+	ParabolSecondaryToken string
+
+	// SignatureAlgorithm selects how requests between Parabol and the plugin are signed. With any
+	// other algorithm than HS256, PrivateKey and ParabolPublicKey replace ParabolToken.
+	SignatureAlgorithm string
+	PrivateKey         string
+	ParabolPublicKey   string
+	KeyID              string
+	ParabolKeyID       string
+
+	// Connections is a JSON list of additional Parabol instances, each serving a set of teams.
+	Connections string
+
+	// VerifyConnection performs a signed request against Parabol before a configuration is saved.
+	VerifyConnection bool
+
+	// EnableMattermostAuditLog additionally writes the plugin's audit records to the Mattermost
+	// audit log.
+	EnableMattermostAuditLog bool
+
+	// RateLimits is a JSON object overriding the per route request limits, see defaultRateLimits.
+	RateLimits string
+
+	// VoteEmojis is a JSON object mapping emoji names to vote values, see defaultVoteEmojis.
+	VoteEmojis string
+
+	// connections is computed from ParabolURL, ParabolToken and Connections in
+	// OnConfigurationChange. Team names are resolved to IDs.
+	connections []*parabolConnection
+
+	// rateLimits is computed from RateLimits in OnConfigurationChange.
+	rateLimits map[string]rateLimit
+
+	// voteEmojis is computed from VoteEmojis in OnConfigurationChange.
+	voteEmojis map[string]string
+
+	// trustedProxyHeaders are the forwarding headers set by a proxy in front of Mattermost, copied
+	// from the server's TrustedProxyIPHeader setting in OnConfigurationChange.
+	trustedProxyHeaders []string
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
@@ -68,6 +130,198 @@ func (p *Plugin) setConfiguration(configuration *configuration) {
 	p.configuration = configuration
 }
 
+// loadConnections parses the connections of the configuration, decrypts their secrets and
+// validates them. Plain HTTP is only accepted when developer mode is enabled on the Mattermost
+// server. True is returned if the configuration holds plain text secrets and should be masked.
+func (p *Plugin) loadConnections(configuration *configuration) ([]*parabolConnection, bool, error) {
+	connections, err := parseConnections(configuration)
+	if err != nil {
+		return nil, false, err
+	}
+	plaintext, err := p.resolveSecrets(connections)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := validateConnections(connections, p.allowInsecureURL()); err != nil {
+		return nil, false, err
+	}
+	if err := p.resolveConnectionTeams(connections); err != nil {
+		return nil, false, err
+	}
+	return connections, plaintext, nil
+}
+
+// validateURL checks that the URL of a Parabol instance can safely be used as a base URL.
+func validateURL(rawURL string, allowInsecure bool) error {
+	if rawURL == "" {
+		return errors.New("Parabol URL is required")
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return errors.Wrap(err, "Parabol URL is not a valid URL")
+	}
+	switch parsed.Scheme {
+	case "https":
+	case "http":
+		if !allowInsecure {
+			return errors.New("Parabol URL must use https unless developer mode is enabled")
+		}
+	default:
+		return errors.Errorf("Parabol URL has unsupported scheme %q", parsed.Scheme)
+	}
+	if parsed.Hostname() == "" {
+		return errors.New("Parabol URL is missing a host")
+	}
+	if parsed.User != nil || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return errors.New("Parabol URL must not contain credentials, a query or a fragment")
+	}
+	return nil
+}
+
+// validateToken rejects shared secrets which can't be used as an HMAC key at all. The error never
+// includes the token itself.
+func validateToken(token string) error {
+	if token == "" {
+		return errors.New("Parabol API Token is required")
+	}
+	if strings.TrimSpace(token) != token || strings.ContainsAny(token, " \t\r\n") {
+		return errors.New("Parabol API Token must not contain whitespace")
+	}
+	return nil
+}
+
+// checkTokenStrength rejects shared secrets which are too short or too predictable. It is only
+// enforced when a configuration is saved, so installations with an older, weaker token keep
+// working until the token is replaced.
+func checkTokenStrength(token string) error {
+	if len(token) < minTokenLength {
+		return errors.Errorf("Parabol API Token must be at least %d characters long", minTokenLength)
+	}
+	if tokenEntropy(token) < minTokenEntropy {
+		return errors.New("Parabol API Token is not random enough, generate a new one")
+	}
+	return nil
+}
+
+// tokenEntropy estimates the entropy of the token in bits from its character distribution.
+func tokenEntropy(token string) float64 {
+	counts := make(map[rune]int)
+	total := 0
+	for _, r := range token {
+		counts[r]++
+		total++
+	}
+	perChar := 0.0
+	for _, count := range counts {
+		f := float64(count) / float64(total)
+		perChar -= f * math.Log2(f)
+	}
+	return perChar * float64(total)
+}
+
+// allowInsecureURL returns true if the server runs in developer mode, where a local Parabol
+// instance is commonly served over plain HTTP.
+func (p *Plugin) allowInsecureURL() bool {
+	config := p.API.GetConfig()
+	return config != nil && config.ServiceSettings.EnableDeveloper != nil && *config.ServiceSettings.EnableDeveloper
+}
+
+// validateConfiguration runs the static checks and, if enabled, the live handshake against every
+// configured Parabol instance.
+func (p *Plugin) validateConfiguration(configuration *configuration) error {
+	connections, _, err := p.loadConnections(configuration)
+	if err != nil {
+		return err
+	}
+	if _, err := parseRateLimits(configuration.RateLimits); err != nil {
+		return err
+	}
+	if _, err := parseVoteEmojis(configuration.VoteEmojis); err != nil {
+		return err
+	}
+	for _, connection := range connections {
+		if err := connection.checkStrength(); err != nil {
+			return errors.Wrapf(err, "Parabol connection %q", connection.Name)
+		}
+	}
+	if configuration.VerifyConnection {
+		for _, connection := range connections {
+			if err := handshake(connection); err != nil {
+				return errors.Wrapf(err, "Parabol connection %q", connection.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// handshake sends a signed request to the health route of Parabol to make sure it is reachable
+// and accepts our signature. While a rotation is in progress Parabol may still only know the secondary token.
+func handshake(connection *parabolConnection) error {
+	if err := connection.prepare(); err != nil {
+		return err
+	}
+	err := handshakeWithSigner(connection.URL, connection.signer)
+	if err == errSignatureRejected && connection.SecondaryToken != "" {
+		signer, signerErr := NewSigner(algHS256, []byte(connection.SecondaryToken), connection.KeyID)
+		if signerErr != nil {
+			return errors.Wrap(signerErr, "failed to create signer")
+		}
+		err = handshakeWithSigner(connection.URL, signer)
+	}
+	return err
+}
+
+func handshakeWithSigner(parabolURL string, signer *httpsign.Signer) error {
+	client := NewSigningClient(signer, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, parabolURL+"/mattermost/health", bytes.NewReader([]byte(`{}`)))
+	if err != nil {
+		return errors.Wrap(err, "failed to create handshake request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to Parabol")
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return errSignatureRejected
+	case res.StatusCode >= http.StatusInternalServerError:
+		return errors.Errorf("Parabol responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// ConfigurationWillBeSaved is invoked before the server configuration is persisted. Returning an
+// error makes the System Console refuse to save an invalid plugin configuration.
+func (p *Plugin) ConfigurationWillBeSaved(newCfg *model.Config) (*model.Config, error) {
+	settings, ok := newCfg.PluginSettings.Plugins[manifest.Id]
+	if !ok {
+		return nil, nil
+	}
+
+	configuration := new(configuration)
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read plugin configuration")
+	}
+	if err := json.Unmarshal(raw, configuration); err != nil {
+		return nil, errors.Wrap(err, "failed to read plugin configuration")
+	}
+	configuration.ParabolURL = strings.TrimSuffix(configuration.ParabolURL, "/")
+
+	if err := p.validateConfiguration(configuration); err != nil {
+		p.API.LogWarn("Rejected invalid Parabol configuration", "reason", err.Error())
+		return nil, errors.Wrap(err, "invalid Parabol configuration")
+	}
+	return nil, nil
+}
+
 // OnConfigurationChange is invoked when configuration changes may have been made.
 func (p *Plugin) OnConfigurationChange() error {
 	configuration := new(configuration)
@@ -77,14 +331,107 @@ func (p *Plugin) OnConfigurationChange() error {
 		return errors.Wrap(err, "failed to load plugin configuration")
 	}
 	configuration.ParabolURL = strings.TrimSuffix(configuration.ParabolURL, "/")
+
+	p.configurationLock.RLock()
+	previous := p.configuration
+	p.configurationLock.RUnlock()
+	changed := changedSettings(previous, configuration)
+
+	// The handshake already ran when the configuration was saved, only repeat the static checks.
+	connections, plaintext, err := p.loadConnections(configuration)
+	if err == nil {
+		configuration.rateLimits, err = parseRateLimits(configuration.RateLimits)
+	}
+	if err == nil {
+		configuration.voteEmojis, err = parseVoteEmojis(configuration.VoteEmojis)
+	}
+	if err != nil {
+		p.API.LogError("Invalid Parabol configuration", "reason", err.Error())
+		p.audit(nil, auditRecord{
+			Action:  auditActionConfiguration,
+			Outcome: auditOutcomeFailure,
+			Details: map[string]string{"settings": strings.Join(changed, ","), "reason": err.Error()},
+		})
+		return errors.Wrap(err, "invalid Parabol configuration")
+	}
+	for _, connection := range connections {
+		if err := connection.checkStrength(); err != nil {
+			p.API.LogWarn("Weak Parabol API Token, replace it with a new one", "connection", connection.Name, "reason", err.Error())
+		}
+		if connection.SecondaryToken != "" {
+			p.API.LogWarn("Parabol secret rotation in progress, the secondary token is still accepted", "connection", connection.Name)
+		}
+	}
+	configuration.connections = connections
+	if serverConfig := p.API.GetConfig(); serverConfig != nil {
+		configuration.trustedProxyHeaders = serverConfig.ServiceSettings.TrustedProxyIPHeader
+	}
 	p.setConfiguration(configuration)
 
+	if len(changed) > 0 {
+		p.audit(nil, auditRecord{
+			Action:  auditActionConfiguration,
+			Outcome: auditOutcomeSuccess,
+			Details: map[string]string{"settings": strings.Join(changed, ",")},
+		})
+	}
+
+	// Move plain text secrets to KV. Saving the configuration from within this hook would re-enter
+	// it, so that is left to a goroutine.
+	if plaintext {
+		go p.maskSecrets()
+	}
+
 	return nil
 }
 
+// changedSettings returns the names of the settings which differ between the configurations.
+// Nothing is reported for the initial load. Secrets being replaced by the placeholder after they
+// were stored in KV don't count as a change.
+func changedSettings(previous, next *configuration) []string {
+	if previous == nil {
+		return nil
+	}
+	var changed []string
+	previousValue := reflect.ValueOf(previous).Elem()
+	nextValue := reflect.ValueOf(next).Elem()
+	for i := 0; i < nextValue.NumField(); i++ {
+		field := nextValue.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		before, after := previousValue.Field(i).Interface(), nextValue.Field(i).Interface()
+		if field.Name == "Connections" {
+			before, after = maskedConnections(previous.Connections), maskedConnections(next.Connections)
+		}
+		if after == secretPlaceholder || reflect.DeepEqual(before, after) {
+			continue
+		}
+		changed = append(changed, field.Name)
+	}
+	return changed
+}
+
+// maskedConnections returns the connections JSON with all secrets masked, so it can be compared
+// before and after the secrets were moved to KV.
+func maskedConnections(raw string) string {
+	var connections []*parabolConnection
+	if err := json.Unmarshal([]byte(raw), &connections); err != nil {
+		return raw
+	}
+	for _, connection := range connections {
+		maskConnection(connection)
+	}
+	masked, err := json.Marshal(connections)
+	if err != nil {
+		return raw
+	}
+	return string(masked)
+}
+
 // Check if we can connect to Parabol
-func (p *Plugin) checkConnection() error {
-	url := p.configuration.ParabolURL + "/components/mattermost-plugin-entry.js"
+func (p *Plugin) checkConnection(connection *parabolConnection) error {
+	url := connection.URL + "/components/mattermost-plugin-entry.js"
 	client := &http.Client{}
 	res, err := client.Get(url)
 	if err != nil {
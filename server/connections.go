@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+	"github.com/yaronf/httpsign"
+)
+
+const (
+	// defaultConnectionName is used for the connection configured through ParabolURL and ParabolToken.
+	defaultConnectionName = "default"
+
+	// teamIDParam and teamIDHeader let callers pick the team, and with it the Parabol instance, a
+	// request is meant for.
+	teamIDParam  = "teamId"
+	teamIDHeader = "X-Parabol-Team-Id"
+
+	// maxConnectionNameLength keeps the KV keys containing the connection name short enough.
+	maxConnectionNameLength = 32
+)
+
+var errNoConnection = errors.New("no Parabol instance is configured for this team")
+
+// parabolConnection describes a single Parabol instance and the Mattermost teams it serves.
+// A connection without teams serves every team which isn't assigned to another connection.
+type parabolConnection struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Token string `json:"token,omitempty"`
+	// SecondaryToken is still accepted for incoming requests while a secret is being rotated.
+	SecondaryToken string   `json:"secondaryToken,omitempty"`
+	Teams          []string `json:"teams"`
+
+	// Algorithm selects the signature algorithm, HS256 with Token if empty. For the asymmetric
+	// algorithms PrivateKey and ParabolPublicKey hold a PEM encoded key or a path to one.
+	Algorithm        string `json:"algorithm,omitempty"`
+	PrivateKey       string `json:"privateKey,omitempty"`
+	ParabolPublicKey string `json:"parabolPublicKey,omitempty"`
+	// KeyID is sent as keyid with our signatures, ParabolKeyID is required on Parabol's.
+	KeyID        string `json:"keyId,omitempty"`
+	ParabolKeyID string `json:"parabolKeyId,omitempty"`
+
+	// signer and verifiers are created from the keys in prepare.
+	signer    *httpsign.Signer
+	verifiers []*httpsign.Verifier
+}
+
+// isSharedSecret reports whether the connection signs with the HMAC secret in Token.
+func (c *parabolConnection) isSharedSecret() bool {
+	return c.Algorithm == "" || c.Algorithm == algHS256
+}
+
+// IsValid checks the connection for errors and loads its keys.
+func (c *parabolConnection) IsValid(allowInsecure bool) error {
+	if err := validateURL(c.URL, allowInsecure); err != nil {
+		return err
+	}
+	if c.isSharedSecret() {
+		if err := validateToken(c.Token); err != nil {
+			return err
+		}
+		if c.SecondaryToken != "" {
+			if err := validateToken(c.SecondaryToken); err != nil {
+				return errors.Wrap(err, "secondary token")
+			}
+		}
+	} else {
+		if c.SecondaryToken != "" {
+			return errors.New("a secondary token can only be used with HS256")
+		}
+		if c.PrivateKey == "" || c.ParabolPublicKey == "" {
+			return errors.Errorf("%s requires a private key and the Parabol public key", c.Algorithm)
+		}
+	}
+	return c.prepare()
+}
+
+// checkStrength checks the shared secrets of the connection with checkTokenStrength.
+func (c *parabolConnection) checkStrength() error {
+	if !c.isSharedSecret() {
+		return nil
+	}
+	if err := checkTokenStrength(c.Token); err != nil {
+		return err
+	}
+	if c.SecondaryToken != "" {
+		if err := checkTokenStrength(c.SecondaryToken); err != nil {
+			return errors.Wrap(err, "secondary token")
+		}
+	}
+	return nil
+}
+
+// servesTeam reports whether the connection was explicitly assigned the given team.
+func (c *parabolConnection) servesTeam(teamID string) bool {
+	for _, team := range c.Teams {
+		if team == teamID {
+			return true
+		}
+	}
+	return false
+}
+
+// parseConnections reads the JSON list of additional connections and merges it with the
+// default connection.
+func parseConnections(c *configuration) ([]*parabolConnection, error) {
+	var connections []*parabolConnection
+	if c.ParabolURL != "" || c.ParabolToken != "" || c.ParabolSecondaryToken != "" {
+		connections = append(connections, &parabolConnection{
+			Name:             defaultConnectionName,
+			URL:              c.ParabolURL,
+			Token:            c.ParabolToken,
+			SecondaryToken:   c.ParabolSecondaryToken,
+			Algorithm:        c.SignatureAlgorithm,
+			PrivateKey:       c.PrivateKey,
+			ParabolPublicKey: c.ParabolPublicKey,
+			KeyID:            c.KeyID,
+			ParabolKeyID:     c.ParabolKeyID,
+		})
+	}
+
+	if strings.TrimSpace(c.Connections) != "" {
+		var additional []*parabolConnection
+		if err := json.Unmarshal([]byte(c.Connections), &additional); err != nil {
+			return nil, errors.Wrap(err, "Parabol connections are not valid JSON")
+		}
+		connections = append(connections, additional...)
+	}
+
+	for _, connection := range connections {
+		connection.Name = strings.TrimSpace(connection.Name)
+		connection.URL = strings.TrimSuffix(strings.TrimSpace(connection.URL), "/")
+	}
+	return connections, nil
+}
+
+// validateConnections checks the individual connections as well as their team assignments.
+func validateConnections(connections []*parabolConnection, allowInsecure bool) error {
+	names := make(map[string]bool)
+	teams := make(map[string]string)
+	catchAll := ""
+	for _, connection := range connections {
+		if connection.Name == "" {
+			return errors.New("every Parabol connection needs a name")
+		}
+		if len(connection.Name) > maxConnectionNameLength {
+			return errors.Errorf("the name of Parabol connection %q is longer than %d characters", connection.Name, maxConnectionNameLength)
+		}
+		if names[connection.Name] {
+			return errors.Errorf("Parabol connection %q is configured twice", connection.Name)
+		}
+		names[connection.Name] = true
+
+		if err := connection.IsValid(allowInsecure); err != nil {
+			return errors.Wrapf(err, "Parabol connection %q", connection.Name)
+		}
+
+		if len(connection.Teams) == 0 {
+			if catchAll != "" {
+				return errors.Errorf("Parabol connections %q and %q both serve all teams, assign teams to one of them", catchAll, connection.Name)
+			}
+			catchAll = connection.Name
+		}
+		for _, team := range connection.Teams {
+			if other, ok := teams[team]; ok {
+				return errors.Errorf("team %q is assigned to both Parabol connections %q and %q", team, other, connection.Name)
+			}
+			teams[team] = connection.Name
+		}
+	}
+	return nil
+}
+
+// resolveConnectionTeams replaces team names with team IDs so requests can be matched by ID.
+func (p *Plugin) resolveConnectionTeams(connections []*parabolConnection) error {
+	for _, connection := range connections {
+		resolved := make([]string, 0, len(connection.Teams))
+		for _, team := range connection.Teams {
+			team = strings.TrimSpace(team)
+			if model.IsValidId(team) {
+				resolved = append(resolved, team)
+				continue
+			}
+			t, appErr := p.API.GetTeamByName(team)
+			if appErr != nil {
+				return errors.Wrapf(appErr, "Parabol connection %q references unknown team %q", connection.Name, team)
+			}
+			resolved = append(resolved, t.Id)
+		}
+		connection.Teams = resolved
+	}
+	return nil
+}
+
+// connectionForTeam returns the connection serving the given team. An empty team ID, e.g. for
+// direct messages, is served by the catch-all connection.
+func (c *configuration) connectionForTeam(teamID string) (*parabolConnection, error) {
+	var catchAll *parabolConnection
+	for _, connection := range c.connections {
+		if teamID != "" && connection.servesTeam(teamID) {
+			return connection, nil
+		}
+		if len(connection.Teams) == 0 {
+			catchAll = connection
+		}
+	}
+	if catchAll == nil {
+		return nil, errNoConnection
+	}
+	return catchAll, nil
+}
+
+// connectionByName returns the connection with the given name, or nil.
+func (c *configuration) connectionByName(name string) *parabolConnection {
+	for _, connection := range c.connections {
+		if connection.Name == name {
+			return connection
+		}
+	}
+	return nil
+}
+
+// connectionForChannel returns the connection serving the team the channel belongs to.
+func (p *Plugin) connectionForChannel(channelID string) (*parabolConnection, error) {
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get channel")
+	}
+	return p.getConfiguration().connectionForTeam(channel.TeamId)
+}
+
+// userServedBy reports whether the connection serves any team of the user. The catch-all
+// connection serves users without a team of their own connection as well.
+func (p *Plugin) userServedBy(userID string, connection *parabolConnection) bool {
+	config := p.getConfiguration()
+	teams, appErr := p.API.GetTeamsForUser(userID)
+	if appErr != nil {
+		return false
+	}
+	if len(teams) == 0 {
+		teamConnection, err := config.connectionForTeam("")
+		return err == nil && teamConnection == connection
+	}
+	for _, team := range teams {
+		if teamConnection, err := config.connectionForTeam(team.Id); err == nil && teamConnection == connection {
+			return true
+		}
+	}
+	return false
+}
+
+// connectionForRequest returns the connection for a request coming from the webapp or the Parabol
+// components. The team is taken from the request if given. Otherwise, e.g. for the components and
+// GraphQL requests of Parabol, which don't know the team, the first team of the user by name which
+// is assigned a connection decides, so the choice is the same for every request.
+func (p *Plugin) connectionForRequest(r *http.Request, userID string) (*parabolConnection, error) {
+	config := p.getConfiguration()
+
+	teamID := r.URL.Query().Get(teamIDParam)
+	if teamID == "" {
+		teamID = r.Header.Get(teamIDHeader)
+	}
+	if teamID != "" {
+		if userID != "" && !p.API.HasPermissionToTeam(userID, teamID, model.PermissionViewTeam) {
+			return nil, errNoConnection
+		}
+		return config.connectionForTeam(teamID)
+	}
+
+	if userID != "" {
+		teams, appErr := p.API.GetTeamsForUser(userID)
+		if appErr == nil {
+			sort.Slice(teams, func(i, j int) bool { return teams[i].Name < teams[j].Name })
+			for _, team := range teams {
+				for _, connection := range config.connections {
+					if connection.servesTeam(team.Id) {
+						return connection, nil
+					}
+				}
+			}
+		}
+	}
+	return config.connectionForTeam("")
+}
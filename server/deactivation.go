@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+)
+
+const (
+	userSweepJobKey = "user_sweep_job"
+
+	// userSweepInterval is how often the users the plugin keeps something of are checked for
+	// deactivated and deleted users. It catches users deactivated while the plugin was disabled,
+	// and deleted users, for which there is no hook.
+	userSweepInterval  = 24 * time.Hour
+	userRemovalTimeout = 10 * time.Second
+)
+
+// userRemovedRequest tells Parabol that a Mattermost user is gone, so it can revoke what it
+// granted them through the integration, like the sessions of logins through the plugin. UserID is
+// the linked Parabol user, if any.
+type userRemovedRequest struct {
+	MattermostUserID string `json:"mattermostUserId"`
+	UserID           string `json:"userId,omitempty"`
+	Email            string `json:"email,omitempty"`
+	Reason           string `json:"reason"`
+}
+
+// UserHasBeenDeactivated removes what the plugin keeps of a deactivated user.
+func (p *Plugin) UserHasBeenDeactivated(_ *plugin.Context, user *model.User) {
+	p.removeUser(user, "deactivated")
+}
+
+// removeUser forgets the user: cached mentions on every node, the identity links and the user's
+// part in schedules and pending membership changes. The Parabol instances serving the user, or
+// linked to them, are told with a signed call. A link is kept until its call succeeded, so the
+// next sweep retries it. Failures are logged and audited, the remaining steps are taken anyway.
+func (p *Plugin) removeUser(user *model.User, reason string) {
+	p.forgetUser(user.Id)
+
+	var failures []string
+	for _, connection := range p.getConfiguration().connections {
+		request := userRemovedRequest{MattermostUserID: user.Id, Email: user.Email, Reason: reason}
+		linked, err := p.identityForUser(connection, user.Id)
+		if err == errUnknownUser {
+			linked = nil
+		} else if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", connection.Name, err))
+			continue
+		}
+		if linked != nil {
+			request.UserID = linked.ParabolUserID
+		} else if !p.userServedBy(user.Id, connection) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), userRemovalTimeout)
+		err = p.callParabol(ctx, connection, "/mattermost/user/removed", &request, nil)
+		cancel()
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", connection.Name, err))
+			continue
+		}
+		if linked == nil {
+			continue
+		}
+		if err := p.deleteIdentity(connection, user.Id); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", connection.Name, err))
+		}
+	}
+	if err := p.removeScheduleCreator(user.Id); err != nil {
+		failures = append(failures, err.Error())
+	}
+	if err := p.removePendingSyncUser(user.Id); err != nil {
+		failures = append(failures, err.Error())
+	}
+
+	record := auditRecord{
+		Action:  auditActionUserRemoved,
+		Target:  user.Id,
+		Outcome: auditOutcomeSuccess,
+		Details: map[string]string{"reason": reason},
+	}
+	if len(failures) > 0 {
+		record.Outcome = auditOutcomeFailure
+		record.Details["errors"] = strings.Join(failures, "; ")
+		p.API.LogWarn("Failed to fully remove user", "user_id", user.Id, "errors", record.Details["errors"])
+	}
+	p.audit(nil, record)
+}
+
+// removeScheduleCreator pauses the meeting schedules created by the user, since meetings are
+// started on their behalf, and drops them from standup schedules. A channel admin resuming a
+// paused schedule takes it over.
+func (p *Plugin) removeScheduleCreator(userID string) error {
+	schedules, err := p.listMeetingSchedules("")
+	if err != nil {
+		return err
+	}
+	for _, schedule := range schedules {
+		if schedule.CreatedBy != userID {
+			continue
+		}
+		paused := false
+		if _, err := p.updateMeetingSchedule(schedule.ID, func(stored *meetingSchedule) {
+			paused = !stored.Paused && stored.CreatedBy == userID
+			if stored.CreatedBy == userID {
+				stored.CreatedBy = ""
+				stored.Paused = true
+			}
+		}); err != nil {
+			return err
+		}
+		if paused {
+			p.postScheduleMessage(schedule, fmt.Sprintf(
+				"The meeting schedule `%s` was paused because the user who created it is no longer active. "+
+					"Run `/parabol schedule resume %s` to take it over.", schedule.ID, schedule.ID))
+		}
+	}
+
+	standups, err := p.listStandupSchedules()
+	if err != nil {
+		return err
+	}
+	for _, schedule := range standups {
+		if schedule.CreatedBy != userID {
+			continue
+		}
+		if _, err := p.updateStandupSchedule(schedule.ChannelID, func(stored *standupSchedule) {
+			if stored.CreatedBy == userID {
+				stored.CreatedBy = ""
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removePendingSyncUser drops the membership changes of the user waiting for approval. Removing
+// them from Parabol teams is left to the reconciliation.
+func (p *Plugin) removePendingSyncUser(userID string) error {
+	links, err := p.listChannelLinks()
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		pending, err := p.getPendingSync(link.ChannelID)
+		if err != nil {
+			return err
+		}
+		if pending == nil || !hasPendingInvite(pending, userID) {
+			continue
+		}
+		if _, err := p.updatePendingSync(link.ChannelID, func(pending *pendingSync) {
+			for email, change := range pending.Changes {
+				if change.UserID == userID && change.Action == syncActionInvite {
+					delete(pending.Changes, email)
+				}
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasPendingInvite(pending *pendingSync, userID string) bool {
+	for _, change := range pending.Changes {
+		if change.UserID == userID && change.Action == syncActionInvite {
+			return true
+		}
+	}
+	return false
+}
+
+// startUserSweep schedules the cluster wide job removing linked users who are gone.
+func (p *Plugin) startUserSweep() error {
+	job, err := cluster.Schedule(p.API, userSweepJobKey, cluster.MakeWaitForInterval(userSweepInterval), p.sweepUsers)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule user sweep")
+	}
+	p.userSweepJob = job
+	return nil
+}
+
+func (p *Plugin) sweepUsers() {
+	userIDs, err := p.sweptUsers()
+	if err != nil {
+		p.API.LogError("Failed to list users to check", "err", err.Error())
+		return
+	}
+	for _, userID := range userIDs {
+		user, appErr := p.API.GetUser(userID)
+		switch {
+		case appErr != nil && appErr.StatusCode == http.StatusNotFound:
+			p.removeUser(&model.User{Id: userID}, "deleted")
+		case appErr != nil:
+			p.API.LogWarn("Failed to check user", "user_id", userID, "err", appErr.Error())
+		case user.DeleteAt != 0:
+			p.removeUser(user, "deactivated")
+		}
+	}
+}
+
+// sweptUsers returns the users the plugin keeps something of: linked users, schedule creators and
+// users invited by pending membership changes.
+func (p *Plugin) sweptUsers() ([]string, error) {
+	seen := make(map[string]bool)
+	for _, connection := range p.getConfiguration().connections {
+		linked, err := p.linkedUsers(connection)
+		if err != nil {
+			return nil, err
+		}
+		for _, userID := range linked {
+			seen[userID] = true
+		}
+	}
+
+	schedules, err := p.listMeetingSchedules("")
+	if err != nil {
+		return nil, err
+	}
+	for _, schedule := range schedules {
+		seen[schedule.CreatedBy] = true
+	}
+	standups, err := p.listStandupSchedules()
+	if err != nil {
+		return nil, err
+	}
+	for _, schedule := range standups {
+		seen[schedule.CreatedBy] = true
+	}
+
+	links, err := p.listChannelLinks()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		pending, err := p.getPendingSync(link.ChannelID)
+		if err != nil {
+			return nil, err
+		}
+		if pending == nil {
+			continue
+		}
+		for _, change := range pending.Changes {
+			if change.Action == syncActionInvite {
+				seen[change.UserID] = true
+			}
+		}
+	}
+
+	delete(seen, "")
+	return sortedKeys(seen), nil
+}
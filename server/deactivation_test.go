@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweptUsers(t *testing.T) {
+	api := newTestAPI()
+	p := newTestPlugin(api)
+	connection := &parabolConnection{Name: "default", URL: "https://parabol.test", Token: testToken}
+	p.setConfiguration(&configuration{connections: []*parabolConnection{connection}})
+
+	require.NoError(t, p.storeIdentity(connection, "parabol-linked", "linked"))
+	require.NoError(t, p.saveMeetingSchedule(&meetingSchedule{ID: "s1", ChannelID: "c1", CreatedBy: "scheduler"}))
+	require.NoError(t, p.saveMeetingSchedule(&meetingSchedule{ID: "s2", ChannelID: "c1", CreatedBy: "linked"}))
+	require.NoError(t, p.saveMeetingSchedule(&meetingSchedule{ID: "s3", ChannelID: "c1"}))
+	require.NoError(t, p.saveStandupSchedule(&standupSchedule{ChannelID: "c2", CreatedBy: "standup"}))
+	require.NoError(t, p.saveChannelLink(&channelLink{ChannelID: "c3", Connection: "default"}))
+	require.NoError(t, p.saveChannelLink(&channelLink{ChannelID: "c4", Connection: "default"}))
+	_, err := p.updatePendingSync("c3", func(pending *pendingSync) {
+		pending.Changes["invited@example.com"] = membershipChange{Email: "invited@example.com", UserID: "invited", Action: syncActionInvite}
+		pending.Changes["removed@example.com"] = membershipChange{Email: "removed@example.com", UserID: "removed", Action: syncActionRemove}
+	})
+	require.NoError(t, err)
+
+	userIDs, err := p.sweptUsers()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"invited", "linked", "scheduler", "standup"}, userIDs)
+}
+
+func TestRemovePendingSyncUser(t *testing.T) {
+	api := newTestAPI()
+	p := newTestPlugin(api)
+	require.NoError(t, p.saveChannelLink(&channelLink{ChannelID: "c1", Connection: "default"}))
+	require.NoError(t, p.saveChannelLink(&channelLink{ChannelID: "c2", Connection: "default"}))
+	require.NoError(t, p.saveChannelLink(&channelLink{ChannelID: "c3", Connection: "default"}))
+	_, err := p.updatePendingSync("c1", func(pending *pendingSync) {
+		pending.Changes["gone@example.com"] = membershipChange{Email: "gone@example.com", UserID: "gone", Action: syncActionInvite}
+		pending.Changes["other@example.com"] = membershipChange{Email: "other@example.com", UserID: "other", Action: syncActionInvite}
+	})
+	require.NoError(t, err)
+	_, err = p.updatePendingSync("c2", func(pending *pendingSync) {
+		pending.Changes["gone@example.com"] = membershipChange{Email: "gone@example.com", UserID: "gone", Action: syncActionRemove}
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, p.removePendingSyncUser("gone"))
+
+	pending, err := p.getPendingSync("c1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]membershipChange{
+		"other@example.com": {Email: "other@example.com", UserID: "other", Action: syncActionInvite},
+	}, pending.Changes)
+	pending, err = p.getPendingSync("c2")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]membershipChange{
+		"gone@example.com": {Email: "gone@example.com", UserID: "gone", Action: syncActionRemove},
+	}, pending.Changes, "removals are left to the reconciliation")
+	pending, err = p.getPendingSync("c3")
+	require.NoError(t, err)
+	assert.Nil(t, pending)
+}
+
+func TestRemoveUser(t *testing.T) {
+	teamID, otherTeamID := model.NewId(), model.NewId()
+	for name, tc := range map[string]struct {
+		teams        []string
+		linked       bool
+		status       int
+		expectCalled bool
+		expectLinked bool
+	}{
+		"linked user": {
+			linked:       true,
+			status:       http.StatusOK,
+			expectCalled: true,
+		},
+		"link is kept when Parabol fails": {
+			linked:       true,
+			status:       http.StatusBadGateway,
+			expectCalled: true,
+			expectLinked: true,
+		},
+		"served user": {
+			teams:        []string{teamID},
+			status:       http.StatusOK,
+			expectCalled: true,
+		},
+		"user of another connection": {
+			teams:  []string{otherTeamID},
+			status: http.StatusOK,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var requests []userRemovedRequest
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/mattermost/user/removed", r.URL.Path)
+				var request userRemovedRequest
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+				requests = append(requests, request)
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			api := newTestAPI()
+			api.teams["gone"] = tc.teams
+			p := newTestPlugin(api)
+			connection := &parabolConnection{Name: "default", URL: server.URL, Token: testToken, Teams: []string{teamID}}
+			p.setConfiguration(&configuration{connections: []*parabolConnection{connection}})
+			if tc.linked {
+				require.NoError(t, p.storeIdentity(connection, "parabol-gone", "gone"))
+			}
+
+			p.removeUser(&model.User{Id: "gone", Email: "gone@example.com"}, "deactivated")
+
+			if tc.expectCalled {
+				expected := userRemovedRequest{MattermostUserID: "gone", Email: "gone@example.com", Reason: "deactivated"}
+				if tc.linked {
+					expected.UserID = "parabol-gone"
+				}
+				assert.Equal(t, []userRemovedRequest{expected}, requests)
+			} else {
+				assert.Empty(t, requests)
+			}
+			linked, err := p.linkedUsers(connection)
+			require.NoError(t, err)
+			if tc.expectLinked {
+				assert.Equal(t, []string{"gone"}, linked)
+			} else {
+				assert.Empty(t, linked)
+			}
+		})
+	}
+}
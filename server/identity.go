@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// identityParabolPrefix maps a Parabol user ID to the linked Mattermost user,
+	// identityUserPrefix the other way round. Both are followed by the connection name, since
+	// every Parabol instance has its own users.
+	identityParabolPrefix = "identity_p_"
+	identityUserPrefix    = "identity_mm_"
+)
+
+// identityIndexKey lists the Mattermost users linked to a Parabol user of the connection.
+func identityIndexKey(connection *parabolConnection) string {
+	return "identity_index_" + connection.Name
+}
+
+func identityUserKeyPrefix(connection *parabolConnection) string {
+	return identityUserPrefix + connection.Name + "_"
+}
+
+func identityParabolKey(connection *parabolConnection, parabolUserID string) string {
+	return identityParabolPrefix + connection.Name + "_" + parabolUserID
+}
+
+func identityUserKey(connection *parabolConnection, userID string) string {
+	return identityUserKeyPrefix(connection) + userID
+}
+
+var errUnknownUser = errors.New("no Mattermost user is linked to the Parabol user")
+
+// identity links a Parabol user to a Mattermost user.
+type identity struct {
+	ParabolUserID    string `json:"parabolUserId"`
+	MattermostUserID string `json:"mattermostUserId"`
+	LinkedAt         int64  `json:"linkedAt"`
+}
+
+// storeIdentity links the Parabol user of the connection to the Mattermost user, replacing a
+// previous link of either of them.
+func (p *Plugin) storeIdentity(connection *parabolConnection, parabolUserID, userID string) error {
+	if previous, err := p.identityForUser(connection, userID); err == nil && previous.ParabolUserID != parabolUserID {
+		if appErr := p.API.KVDelete(identityParabolKey(connection, previous.ParabolUserID)); appErr != nil {
+			return errors.Wrap(appErr, "failed to remove previous identity")
+		}
+	}
+	raw, err := json.Marshal(identity{
+		ParabolUserID:    parabolUserID,
+		MattermostUserID: userID,
+		LinkedAt:         model.GetMillis(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize identity")
+	}
+	if appErr := p.API.KVSet(identityParabolKey(connection, parabolUserID), raw); appErr != nil {
+		return errors.Wrap(appErr, "failed to store identity")
+	}
+	if appErr := p.API.KVSet(identityUserKey(connection, userID), raw); appErr != nil {
+		return errors.Wrap(appErr, "failed to store identity")
+	}
+	return p.addToIndex(identityIndexKey(connection), identityUserKeyPrefix(connection), userID)
+}
+
+func (p *Plugin) getIdentity(key string) (*identity, error) {
+	raw, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to read identity")
+	}
+	if raw == nil {
+		return nil, errUnknownUser
+	}
+	var linked identity
+	if err := json.Unmarshal(raw, &linked); err != nil {
+		return nil, errors.Wrap(err, "invalid identity")
+	}
+	return &linked, nil
+}
+
+// identityForUser returns the Parabol identity of the connection linked to the Mattermost user.
+func (p *Plugin) identityForUser(connection *parabolConnection, userID string) (*identity, error) {
+	return p.getIdentity(identityUserKey(connection, userID))
+}
+
+// deleteIdentity removes the link of the Mattermost user to the connection, if any.
+func (p *Plugin) deleteIdentity(connection *parabolConnection, userID string) error {
+	linked, err := p.identityForUser(connection, userID)
+	if err == errUnknownUser {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if appErr := p.API.KVDelete(identityParabolKey(connection, linked.ParabolUserID)); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete identity")
+	}
+	if appErr := p.API.KVDelete(identityUserKey(connection, userID)); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete identity")
+	}
+	return p.removeFromIndex(identityIndexKey(connection), identityUserKeyPrefix(connection), userID)
+}
+
+// linkedUsers returns the Mattermost users linked to a Parabol user of the connection.
+func (p *Plugin) linkedUsers(connection *parabolConnection) ([]string, error) {
+	return p.readIndex(identityIndexKey(connection), identityUserKeyPrefix(connection))
+}
+
+// lookupUser returns the active Mattermost user linked to the Parabol user ID of the connection or,
+// if there is no link, the one with the email. Users no team of which is served by the connection
+// are unknown to it. Nothing is stored, linked reports whether the user was found by the link.
+func (p *Plugin) lookupUser(connection *parabolConnection, parabolUserID, email string) (user *model.User, linked bool, err error) {
+	if parabolUserID != "" {
+		link, err := p.getIdentity(identityParabolKey(connection, parabolUserID))
+		switch {
+		case err == nil:
+			var appErr *model.AppError
+			if user, appErr = p.API.GetUser(link.MattermostUserID); appErr != nil {
+				return nil, false, errors.Wrap(appErr, "failed to get linked user")
+			}
+			linked = true
+		case err != errUnknownUser:
+			return nil, false, err
+		}
+	}
+	if user == nil {
+		if email == "" {
+			return nil, false, errUnknownUser
+		}
+		var appErr *model.AppError
+		if user, appErr = p.API.GetUserByEmail(email); appErr != nil {
+			if appErr.StatusCode == http.StatusNotFound {
+				return nil, false, errUnknownUser
+			}
+			return nil, false, errors.Wrap(appErr, "failed to get user by email")
+		}
+	}
+	if user.DeleteAt > 0 || !p.userServedBy(user.Id, connection) {
+		return nil, false, errUnknownUser
+	}
+	return user, linked, nil
+}
+
+// resolveUser returns the user like lookupUser and links a user found by email to the Parabol
+// user for the next time.
+func (p *Plugin) resolveUser(connection *parabolConnection, parabolUserID, email string) (*model.User, error) {
+	user, linked, err := p.lookupUser(connection, parabolUserID, email)
+	if err != nil {
+		return nil, err
+	}
+	if !linked && parabolUserID != "" {
+		if err := p.storeIdentity(connection, parabolUserID, user.Id); err != nil {
+			p.API.LogWarn("Failed to link Parabol user", "user_id", user.Id, "err", err.Error())
+		}
+	}
+	return user, nil
+}
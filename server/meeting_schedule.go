@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+)
+
+const (
+	meetingSchedulePrefix   = "meeting_schedule_"
+	meetingScheduleIndexKey = "meeting_index"
+	meetingScheduleJobKey   = "meeting_schedule_job"
+
+	// missedRunGracePeriod is how late a meeting is still started, e.g. when Parabol was
+	// unreachable or the server was down. Older runs are skipped with a note in the channel.
+	missedRunGracePeriod = time.Hour
+	startMeetingTimeout  = 30 * time.Second
+
+	meetingScheduleIDLength = 8
+)
+
+// meetingTypes maps the names accepted by /parabol schedule to Parabol's meeting types.
+var meetingTypes = map[string]string{
+	"retro":         "retrospective",
+	"retrospective": "retrospective",
+	"checkin":       "action",
+	"poker":         "poker",
+	"standup":       "teamPrompt",
+}
+
+// meetingSchedule starts a Parabol meeting for a channel whenever its recurrence rule is due.
+type meetingSchedule struct {
+	ID          string `json:"id"`
+	ChannelID   string `json:"channelId"`
+	MeetingType string `json:"meetingType"`
+	Rule        string `json:"rule"`
+	TimeZone    string `json:"timeZone"`
+	CreatedBy   string `json:"createdBy"`
+	// CreatedAt anchors the recurrence, e.g. every other week is counted from its week.
+	CreatedAt int64 `json:"createdAt"`
+	Paused    bool  `json:"paused,omitempty"`
+	LastRun   int64 `json:"lastRun,omitempty"`
+	NextRun   int64 `json:"nextRun,omitempty"`
+}
+
+// startMeetingRequest asks Parabol to start a meeting for a channel.
+type startMeetingRequest struct {
+	MeetingType string `json:"meetingType"`
+	ChannelID   string `json:"channelId"`
+	TeamID      string `json:"teamId"`
+	ScheduleID  string `json:"scheduleId"`
+	Email       string `json:"email,omitempty"`
+}
+
+type startMeetingResponse struct {
+	MeetingID   string `json:"meetingId"`
+	MeetingName string `json:"meetingName"`
+	MeetingURL  string `json:"meetingUrl"`
+}
+
+// advance sets NextRun to the first run of the schedule after the given time, or 0 if the rule
+// never happens again.
+func (s *meetingSchedule) advance(after time.Time) error {
+	s.NextRun = 0
+	rule, err := parseRecurrence(s.Rule)
+	if err != nil {
+		return err
+	}
+	location, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return errors.Wrap(err, "invalid time zone")
+	}
+	if next := rule.next(after, time.UnixMilli(s.CreatedAt), location); !next.IsZero() {
+		s.NextRun = next.UnixMilli()
+	}
+	return nil
+}
+
+func (s *meetingSchedule) format() string {
+	var status string
+	switch {
+	case s.Paused:
+		status = "paused"
+	case s.NextRun == 0:
+		status = "no further runs"
+	default:
+		next := time.UnixMilli(s.NextRun).UTC()
+		if location, err := time.LoadLocation(s.TimeZone); err == nil {
+			next = next.In(location)
+		}
+		status = "next run " + next.Format(time.RFC1123)
+	}
+	return fmt.Sprintf("`%s` %s `%s` (%s), %s", s.ID, s.MeetingType, s.Rule, s.TimeZone, status)
+}
+
+func (p *Plugin) getMeetingSchedule(id string) (*meetingSchedule, error) {
+	raw, appErr := p.API.KVGet(meetingSchedulePrefix + id)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to read meeting schedule")
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	var schedule meetingSchedule
+	if err := json.Unmarshal(raw, &schedule); err != nil {
+		return nil, errors.Wrap(err, "invalid meeting schedule")
+	}
+	return &schedule, nil
+}
+
+func (p *Plugin) saveMeetingSchedule(schedule *meetingSchedule) error {
+	raw, err := json.Marshal(schedule)
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize meeting schedule")
+	}
+	if appErr := p.API.KVSet(meetingSchedulePrefix+schedule.ID, raw); appErr != nil {
+		return errors.Wrap(appErr, "failed to store meeting schedule")
+	}
+	return p.addToIndex(meetingScheduleIndexKey, meetingSchedulePrefix, schedule.ID)
+}
+
+// updateMeetingSchedule applies update to the stored schedule, retrying if it was changed
+// concurrently. It returns false without calling update if the schedule was deleted.
+func (p *Plugin) updateMeetingSchedule(id string, update func(schedule *meetingSchedule)) (bool, error) {
+	for range 10 {
+		raw, appErr := p.API.KVGet(meetingSchedulePrefix + id)
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "failed to read meeting schedule")
+		}
+		if raw == nil {
+			return false, nil
+		}
+		var schedule meetingSchedule
+		if err := json.Unmarshal(raw, &schedule); err != nil {
+			return false, errors.Wrap(err, "invalid meeting schedule")
+		}
+		update(&schedule)
+		updated, err := json.Marshal(&schedule)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to serialize meeting schedule")
+		}
+		ok, appErr := p.API.KVSetWithOptions(meetingSchedulePrefix+id, updated, model.PluginKVSetOptions{Atomic: true, OldValue: raw})
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "failed to store meeting schedule")
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, errors.New("too much contention updating meeting schedule")
+}
+
+func (p *Plugin) deleteMeetingSchedule(id string) error {
+	if appErr := p.API.KVDelete(meetingSchedulePrefix + id); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete meeting schedule")
+	}
+	return p.removeFromIndex(meetingScheduleIndexKey, meetingSchedulePrefix, id)
+}
+
+// listMeetingSchedules returns all schedules, or those of a channel if channelID is set, ordered
+// by their next run.
+func (p *Plugin) listMeetingSchedules(channelID string) ([]*meetingSchedule, error) {
+	ids, err := p.readIndex(meetingScheduleIndexKey, meetingSchedulePrefix)
+	if err != nil {
+		return nil, err
+	}
+	schedules := make([]*meetingSchedule, 0, len(ids))
+	for _, id := range ids {
+		schedule, err := p.getMeetingSchedule(id)
+		if err != nil {
+			p.API.LogWarn("Skipping invalid meeting schedule", "schedule_id", id, "err", err.Error())
+			continue
+		}
+		if schedule == nil {
+			if err := p.removeFromIndex(meetingScheduleIndexKey, meetingSchedulePrefix, id); err != nil {
+				p.API.LogWarn("Failed to remove meeting schedule from the index", "schedule_id", id, "err", err.Error())
+			}
+			continue
+		}
+		if channelID == "" || schedule.ChannelID == channelID {
+			schedules = append(schedules, schedule)
+		}
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].NextRun < schedules[j].NextRun })
+	return schedules, nil
+}
+
+// startMeetingSchedules schedules the cluster wide job starting the scheduled meetings.
+func (p *Plugin) startMeetingSchedules() error {
+	job, err := cluster.Schedule(p.API, meetingScheduleJobKey, cluster.MakeWaitForRoundedInterval(time.Minute), p.runMeetingSchedules)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule meetings")
+	}
+	p.meetingScheduleJob = job
+	return nil
+}
+
+// runMeetingSchedules starts the meetings which are due. A run which failed is retried every
+// minute within missedRunGracePeriod. Runs missed for longer, e.g. during downtime, are skipped
+// instead of starting several meetings at once, and the channel is told about it. Schedules of
+// archived channels are left alone until the channel is restored.
+func (p *Plugin) runMeetingSchedules() {
+	schedules, err := p.listMeetingSchedules("")
+	if err != nil {
+		p.API.LogError("Failed to read meeting schedules", "err", err.Error())
+		return
+	}
+	now := time.Now()
+	for _, schedule := range schedules {
+		if schedule.Paused || schedule.NextRun == 0 || schedule.NextRun > now.UnixMilli() {
+			continue
+		}
+		channel, appErr := p.API.GetChannel(schedule.ChannelID)
+		if appErr != nil {
+			p.API.LogWarn("Failed to get channel of meeting schedule", "schedule_id", schedule.ID, "err", appErr.Error())
+			continue
+		}
+		if channel.DeleteAt != 0 {
+			continue
+		}
+
+		due := time.UnixMilli(schedule.NextRun)
+		if now.Sub(due) > missedRunGracePeriod {
+			p.API.LogWarn("Skipping missed meeting", "schedule_id", schedule.ID, "due", due.String())
+			if p.advanceMeetingSchedule(schedule, false, now) {
+				p.postScheduleMessage(schedule, fmt.Sprintf("The %s scheduled for %s was skipped because it couldn't be started in time.",
+					schedule.MeetingType, due.UTC().Format(time.RFC1123)))
+			}
+			continue
+		}
+
+		connection, meeting, err := p.startScheduledMeeting(schedule, channel)
+		if err != nil {
+			p.API.LogWarn("Failed to start scheduled meeting", "schedule_id", schedule.ID, "err", err.Error())
+			continue
+		}
+		// The meeting was started, so the run is saved before posting, which can't be retried.
+		p.advanceMeetingSchedule(schedule, true, now)
+		p.postMeetingStarted(schedule, channel, connection, meeting)
+	}
+}
+
+// advanceMeetingSchedule moves the stored schedule past the run it was read with, recording it as
+// last run if started. The schedule is read again, so a pause or delete while the meeting was
+// started is kept. It returns false if the schedule was deleted or another node already moved on.
+func (p *Plugin) advanceMeetingSchedule(schedule *meetingSchedule, started bool, now time.Time) bool {
+	advanced := false
+	found, err := p.updateMeetingSchedule(schedule.ID, func(stored *meetingSchedule) {
+		advanced = false
+		if stored.NextRun != schedule.NextRun {
+			return
+		}
+		advanced = true
+		if started {
+			stored.LastRun = stored.NextRun
+		}
+		if err := stored.advance(now); err != nil {
+			p.API.LogError("Invalid meeting schedule", "schedule_id", stored.ID, "err", err.Error())
+		}
+	})
+	if err != nil {
+		p.API.LogError("Failed to update meeting schedule", "schedule_id", schedule.ID, "err", err.Error())
+	}
+	return found && advanced
+}
+
+// startScheduledMeeting asks Parabol to start the meeting of the schedule.
+func (p *Plugin) startScheduledMeeting(schedule *meetingSchedule, channel *model.Channel) (*parabolConnection, *startMeetingResponse, error) {
+	connection, err := p.getConfiguration().connectionForTeam(channel.TeamId)
+	if err != nil {
+		return nil, nil, err
+	}
+	request := startMeetingRequest{
+		MeetingType: schedule.MeetingType,
+		ChannelID:   channel.Id,
+		TeamID:      channel.TeamId,
+		ScheduleID:  schedule.ID,
+	}
+	if user, appErr := p.API.GetUser(schedule.CreatedBy); appErr == nil {
+		request.Email = user.Email
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), startMeetingTimeout)
+	defer cancel()
+	var meeting startMeetingResponse
+	if err := p.callParabol(ctx, connection, "/mattermost/meeting", &request, &meeting); err != nil {
+		return nil, nil, err
+	}
+	return connection, &meeting, nil
+}
+
+// postMeetingStarted posts the link of a started meeting to the channel. If Parabol returned an
+// invalid meeting, a plain note is posted instead. Errors are only logged, the meeting runs anyway.
+func (p *Plugin) postMeetingStarted(schedule *meetingSchedule, channel *model.Channel, connection *parabolConnection, meeting *startMeetingResponse) {
+	n := &notification{
+		Message: fmt.Sprintf("The scheduled %s [%s](%s) has started.", schedule.MeetingType, escapeLinkText(meeting.MeetingName), meeting.MeetingURL),
+		Type:    postTypePrefix + "meeting",
+		Data: map[string]any{
+			"version":     float64(1),
+			"meetingId":   meeting.MeetingID,
+			"meetingName": meeting.MeetingName,
+			"meetingUrl":  meeting.MeetingURL,
+			"meetingType": schedule.MeetingType,
+		},
+	}
+	if err := n.validate(); err != nil {
+		p.API.LogWarn("Parabol returned an invalid meeting", "schedule_id", schedule.ID, "err", err.Error())
+		p.postScheduleMessage(schedule, fmt.Sprintf("The scheduled %s has started in Parabol.", schedule.MeetingType))
+		return
+	}
+	post := n.toPost(connection.Name)
+	post.ChannelId = channel.Id
+	if _, err := p.createBotPost(post); err != nil {
+		p.API.LogError("Failed to post started meeting", "schedule_id", schedule.ID, "err", err.Error())
+	}
+}
+
+// postScheduleMessage tells the channel of a schedule about it, errors are only logged.
+func (p *Plugin) postScheduleMessage(schedule *meetingSchedule, message string) {
+	if _, err := p.createBotPost(&model.Post{ChannelId: schedule.ChannelID, Message: message}); err != nil {
+		p.API.LogError("Failed to post schedule message", "schedule_id", schedule.ID, "err", err.Error())
+	}
+}
+
+// createBotPost creates the post as the bot user.
+func (p *Plugin) createBotPost(post *model.Post) (*model.Post, error) {
+	botID, appErr := p.API.KVGet(botUserID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get bot user")
+	}
+	post.UserId = string(botID)
+	created, appErr := p.API.CreatePost(post)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to create post")
+	}
+	return created, nil
+}
+
+// executeScheduleCommand handles `/parabol schedule ...` for the current channel.
+func (p *Plugin) executeScheduleCommand(args *model.CommandArgs, fields []string) *model.CommandResponse {
+	const usage = "Usage: `/parabol schedule add <retro|checkin|poker|standup> <rule> [time zone]`, `/parabol schedule list` " +
+		"or `/parabol schedule pause|resume|delete <id>`. A rule looks like `FREQ=WEEKLY;INTERVAL=2;BYDAY=FR;BYHOUR=15`."
+	if len(fields) == 0 {
+		return ephemeralResponse(usage)
+	}
+
+	channel, appErr := p.API.GetChannel(args.ChannelId)
+	if appErr != nil {
+		return ephemeralResponse("Failed to get the channel.")
+	}
+	if channel.IsGroupOrDirect() {
+		return ephemeralResponse("Meetings can only be scheduled in public or private channels.")
+	}
+	if fields[0] != "list" && !p.canManageChannel(args.UserId, channel) {
+		return ephemeralResponse("You need permission to manage this channel to change its meeting schedules.")
+	}
+
+	switch fields[0] {
+	case "list":
+		schedules, err := p.listMeetingSchedules(channel.Id)
+		if err != nil {
+			p.API.LogError("Failed to read meeting schedules", "channel_id", channel.Id, "err", err.Error())
+			return ephemeralResponse("Failed to read the meeting schedules.")
+		}
+		if len(schedules) == 0 {
+			return ephemeralResponse("No meetings are scheduled in this channel.")
+		}
+		text := strings.Builder{}
+		text.WriteString("Meetings scheduled in this channel:")
+		for _, schedule := range schedules {
+			text.WriteString("\n- " + schedule.format())
+		}
+		return ephemeralResponse(text.String())
+
+	case "add":
+		if len(fields) < 3 || len(fields) > 4 {
+			return ephemeralResponse(usage)
+		}
+		meetingType, ok := meetingTypes[strings.ToLower(fields[1])]
+		if !ok {
+			return ephemeralResponse(fmt.Sprintf("Unknown meeting type `%s`, use retro, checkin, poker or standup.", fields[1]))
+		}
+		if _, err := parseRecurrence(fields[2]); err != nil {
+			return ephemeralResponse(fmt.Sprintf("Invalid rule: %s.", err))
+		}
+		timeZone := "UTC"
+		if user, appErr := p.API.GetUser(args.UserId); appErr == nil && user.GetPreferredTimezone() != "" {
+			timeZone = user.GetPreferredTimezone()
+		}
+		if len(fields) == 4 {
+			timeZone = fields[3]
+		}
+		if _, err := time.LoadLocation(timeZone); err != nil {
+			return ephemeralResponse(fmt.Sprintf("Unknown time zone `%s`, use a name like `Europe/Berlin`.", timeZone))
+		}
+		if _, err := p.getConfiguration().connectionForTeam(channel.TeamId); err != nil {
+			return ephemeralResponse("No Parabol instance is configured for this team.")
+		}
+
+		now := time.Now()
+		schedule := &meetingSchedule{
+			ID:          model.NewId()[:meetingScheduleIDLength],
+			ChannelID:   channel.Id,
+			MeetingType: meetingType,
+			Rule:        strings.ToUpper(fields[2]),
+			TimeZone:    timeZone,
+			CreatedBy:   args.UserId,
+			CreatedAt:   now.UnixMilli(),
+		}
+		if err := schedule.advance(now); err != nil || schedule.NextRun == 0 {
+			return ephemeralResponse("The rule never happens, check the day of the month.")
+		}
+		if err := p.saveMeetingSchedule(schedule); err != nil {
+			p.API.LogError("Failed to store meeting schedule", "channel_id", channel.Id, "err", err.Error())
+			return ephemeralResponse("Failed to store the meeting schedule.")
+		}
+		return ephemeralResponse("Scheduled " + schedule.format() + ".")
+
+	case "pause", "resume", "delete":
+		if len(fields) != 2 {
+			return ephemeralResponse(usage)
+		}
+		schedule, err := p.getMeetingSchedule(fields[1])
+		if err != nil {
+			p.API.LogError("Failed to read meeting schedule", "schedule_id", fields[1], "err", err.Error())
+			return ephemeralResponse("Failed to read the meeting schedule.")
+		}
+		if schedule == nil || schedule.ChannelID != channel.Id {
+			return ephemeralResponse(fmt.Sprintf("No meeting schedule `%s` in this channel.", fields[1]))
+		}
+
+		if fields[0] == "delete" {
+			if err := p.deleteMeetingSchedule(schedule.ID); err != nil {
+				p.API.LogError("Failed to delete meeting schedule", "schedule_id", schedule.ID, "err", err.Error())
+				return ephemeralResponse("Failed to delete the meeting schedule.")
+			}
+			return ephemeralResponse(fmt.Sprintf("Deleted the meeting schedule `%s`.", schedule.ID))
+		}
+
+		paused := fields[0] == "pause"
+		var ruleErr error
+		found, err := p.updateMeetingSchedule(schedule.ID, func(stored *meetingSchedule) {
+			stored.Paused = paused
+			if !paused && stored.CreatedBy == "" {
+				// The creator is gone, meetings are started on behalf of the user resuming it.
+				stored.CreatedBy = args.UserId
+			}
+			if !paused {
+				// Runs missed while paused are not made up for.
+				ruleErr = stored.advance(time.Now())
+			}
+			schedule = stored
+		})
+		if err != nil {
+			p.API.LogError("Failed to store meeting schedule", "schedule_id", schedule.ID, "err", err.Error())
+			return ephemeralResponse("Failed to store the meeting schedule.")
+		}
+		if !found {
+			return ephemeralResponse(fmt.Sprintf("No meeting schedule `%s` in this channel.", fields[1]))
+		}
+		if ruleErr != nil {
+			return ephemeralResponse(fmt.Sprintf("Invalid rule: %s.", ruleErr))
+		}
+		return ephemeralResponse("Updated " + schedule.format() + ".")
+
+	default:
+		return ephemeralResponse(usage)
+	}
+}
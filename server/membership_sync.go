@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+)
+
+const (
+	syncPendingPrefix = "sync_pending_"
+	syncJobKey        = "membership_sync_job"
+
+	// syncInterval is how often linked channels are reconciled with their Parabol teams, catching
+	// changes the hooks missed, e.g. while the plugin was disabled.
+	syncInterval = time.Hour
+	syncTimeout  = 30 * time.Second
+)
+
+// Membership changes of a Parabol team.
+const (
+	syncActionInvite = "invite"
+	syncActionRemove = "remove"
+)
+
+// membershipChange invites a channel member to the Parabol team or removes a former one.
+type membershipChange struct {
+	Email       string `json:"email"`
+	UserID      string `json:"userId"`
+	Action      string `json:"action"`
+	RequestedAt int64  `json:"requestedAt"`
+}
+
+func (c membershipChange) String() string {
+	return fmt.Sprintf("%s %s", c.Action, c.Email)
+}
+
+// pendingSync are the changes of a channel in approval mode. Rejected changes are not proposed
+// again by the reconciliation, only if the user joins or leaves the channel again.
+type pendingSync struct {
+	Changes  map[string]membershipChange `json:"changes"`
+	Rejected map[string]string           `json:"rejected,omitempty"`
+}
+
+// teamMembersRequest lists the members of a Parabol team.
+type teamMembersRequest struct {
+	TeamID    string `json:"teamId"`
+	ChannelID string `json:"channelId"`
+}
+
+type teamMembersResponse struct {
+	Emails []string `json:"emails"`
+}
+
+// teamMembersUpdate invites and removes members of a Parabol team by email.
+type teamMembersUpdate struct {
+	TeamID    string   `json:"teamId"`
+	ChannelID string   `json:"channelId"`
+	Invite    []string `json:"invite,omitempty"`
+	Remove    []string `json:"remove,omitempty"`
+}
+
+// membershipDiff compares the channel members with the Parabol team. Only Parabol members who are
+// Mattermost users are removed, guests from outside of Mattermost are left alone.
+func (p *Plugin) membershipDiff(ctx context.Context, link *channelLink) ([]membershipChange, error) {
+	connection := p.getConfiguration().connectionByName(link.Connection)
+	if connection == nil {
+		return nil, errNoConnection
+	}
+	users, err := p.channelUsers(link.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+	var members teamMembersResponse
+	if err := p.callParabol(ctx, connection, "/mattermost/team/members/list", &teamMembersRequest{
+		TeamID:    link.ParabolTeamID,
+		ChannelID: link.ChannelID,
+	}, &members); err != nil {
+		return nil, err
+	}
+
+	return membershipChanges(users, members.Emails, func(email string) *model.User {
+		user, appErr := p.API.GetUserByEmail(email)
+		if appErr != nil {
+			return nil
+		}
+		return user
+	}, model.GetMillis()), nil
+}
+
+// membershipChanges invites the channel members missing from the team and removes the team
+// members who left the channel. userByEmail returns the Mattermost user of a team member, or nil
+// for guests from outside of Mattermost.
+func membershipChanges(users []*model.User, teamEmails []string, userByEmail func(string) *model.User, now int64) []membershipChange {
+	inTeam := make(map[string]bool, len(teamEmails))
+	for _, email := range teamEmails {
+		inTeam[strings.ToLower(email)] = true
+	}
+	inChannel := make(map[string]bool, len(users))
+	var changes []membershipChange
+	for _, user := range users {
+		email := strings.ToLower(user.Email)
+		inChannel[email] = true
+		if !inTeam[email] {
+			changes = append(changes, membershipChange{Email: email, UserID: user.Id, Action: syncActionInvite, RequestedAt: now})
+		}
+	}
+	for _, email := range sortedKeys(inTeam) {
+		if inChannel[email] {
+			continue
+		}
+		user := userByEmail(email)
+		if user == nil || user.IsBot {
+			continue
+		}
+		changes = append(changes, membershipChange{Email: email, UserID: user.Id, Action: syncActionRemove, RequestedAt: now})
+	}
+	return changes
+}
+
+// applyMembershipChanges sends the changes to Parabol and records them in the audit log.
+func (p *Plugin) applyMembershipChanges(ctx context.Context, link *channelLink, actorID string, changes []membershipChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	connection := p.getConfiguration().connectionByName(link.Connection)
+	if connection == nil {
+		return errNoConnection
+	}
+	update := teamMembersUpdate{TeamID: link.ParabolTeamID, ChannelID: link.ChannelID}
+	for _, change := range changes {
+		if change.Action == syncActionInvite {
+			update.Invite = append(update.Invite, change.Email)
+		} else {
+			update.Remove = append(update.Remove, change.Email)
+		}
+	}
+	err := p.callParabol(ctx, connection, "/mattermost/team/members", &update, nil)
+	record := auditRecord{
+		ActorID: actorID,
+		Action:  auditActionMembershipSync,
+		Target:  link.ChannelID,
+		Outcome: auditOutcomeSuccess,
+		Details: map[string]string{
+			"team":   link.ParabolTeamID,
+			"invite": strings.Join(update.Invite, ","),
+			"remove": strings.Join(update.Remove, ","),
+		},
+	}
+	if err != nil {
+		record.Outcome = auditOutcomeFailure
+		record.Details["reason"] = err.Error()
+	}
+	p.audit(nil, record)
+	return err
+}
+
+// getPendingSync returns the pending changes of a channel, or nil if there are none.
+func (p *Plugin) getPendingSync(channelID string) (*pendingSync, error) {
+	raw, appErr := p.API.KVGet(syncPendingPrefix + channelID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to read pending changes")
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	var pending pendingSync
+	if err := json.Unmarshal(raw, &pending); err != nil {
+		return nil, errors.Wrap(err, "invalid pending changes")
+	}
+	return &pending, nil
+}
+
+// updatePendingSync atomically changes the pending changes of a channel.
+func (p *Plugin) updatePendingSync(channelID string, update func(*pendingSync)) (*pendingSync, error) {
+	key := syncPendingPrefix + channelID
+	for range 10 {
+		raw, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to read pending changes")
+		}
+		pending := pendingSync{}
+		if raw != nil {
+			if err := json.Unmarshal(raw, &pending); err != nil {
+				return nil, errors.Wrap(err, "invalid pending changes")
+			}
+		}
+		if pending.Changes == nil {
+			pending.Changes = make(map[string]membershipChange)
+		}
+		if pending.Rejected == nil {
+			pending.Rejected = make(map[string]string)
+		}
+		update(&pending)
+		updated, err := json.Marshal(&pending)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to serialize pending changes")
+		}
+		ok, appErr := p.API.KVSetWithOptions(key, updated, model.PluginKVSetOptions{Atomic: true, OldValue: raw})
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to store pending changes")
+		}
+		if ok {
+			return &pending, nil
+		}
+	}
+	return nil, errors.New("too much contention updating pending changes")
+}
+
+// syncMembership applies or, in approval mode, queues the changes of a linked channel.
+// explicit changes come from a user joining or leaving and override earlier rejections.
+func (p *Plugin) syncMembership(ctx context.Context, link *channelLink, changes []membershipChange, explicit bool) error {
+	switch link.SyncMode {
+	case syncModeAuto:
+		return p.applyMembershipChanges(ctx, link, "", changes)
+	case syncModeApproval:
+		_, err := p.updatePendingSync(link.ChannelID, func(pending *pendingSync) {
+			for _, change := range changes {
+				if explicit {
+					delete(pending.Rejected, change.Email)
+				} else if pending.Rejected[change.Email] == change.Action {
+					continue
+				}
+				pending.Changes[change.Email] = change
+			}
+		})
+		return err
+	}
+	return nil
+}
+
+// handleMembershipHook syncs a single user joining or leaving a linked channel.
+func (p *Plugin) handleMembershipHook(channelID, userID, action string) {
+	link, err := p.getChannelLink(channelID)
+	if err != nil {
+		p.API.LogError("Failed to read channel link", "channel_id", channelID, "err", err.Error())
+		return
+	}
+	if link == nil || link.SyncMode == "" || link.SyncMode == syncModeOff {
+		return
+	}
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil || user.IsBot {
+		return
+	}
+	change := membershipChange{Email: strings.ToLower(user.Email), UserID: user.Id, Action: action, RequestedAt: model.GetMillis()}
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	if err := p.syncMembership(ctx, link, []membershipChange{change}, true); err != nil {
+		// The reconciliation catches up later.
+		p.API.LogWarn("Failed to sync channel membership", "channel_id", channelID, "user_id", userID, "err", err.Error())
+	}
+}
+
+// UserHasJoinedChannel invites new members of a synced channel to its Parabol team.
+func (p *Plugin) UserHasJoinedChannel(_ *plugin.Context, member *model.ChannelMember, _ *model.User) {
+	p.handleMembershipHook(member.ChannelId, member.UserId, syncActionInvite)
+}
+
+// UserHasLeftChannel removes former members of a synced channel from its Parabol team.
+func (p *Plugin) UserHasLeftChannel(_ *plugin.Context, member *model.ChannelMember, _ *model.User) {
+	p.handleMembershipHook(member.ChannelId, member.UserId, syncActionRemove)
+}
+
+// startMembershipSync schedules the cluster wide reconciliation of synced channels.
+func (p *Plugin) startMembershipSync() error {
+	job, err := cluster.Schedule(p.API, syncJobKey, cluster.MakeWaitForInterval(syncInterval), p.runMembershipSync)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule membership sync")
+	}
+	p.membershipSyncJob = job
+	return nil
+}
+
+func (p *Plugin) runMembershipSync() {
+	links, err := p.listChannelLinks()
+	if err != nil {
+		p.API.LogError("Failed to read channel links", "err", err.Error())
+		return
+	}
+	for _, link := range links {
+		if link.SyncMode == "" || link.SyncMode == syncModeOff || link.Paused {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+		changes, err := p.membershipDiff(ctx, link)
+		if err == nil {
+			err = p.syncMembership(ctx, link, changes, false)
+		}
+		cancel()
+		if err != nil {
+			p.API.LogWarn("Failed to reconcile channel membership", "channel_id", link.ChannelID, "err", err.Error())
+		}
+	}
+}
+
+func formatChanges(changes []membershipChange) string {
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Action != changes[j].Action {
+			return changes[i].Action < changes[j].Action
+		}
+		return changes[i].Email < changes[j].Email
+	})
+	text := strings.Builder{}
+	for _, change := range changes {
+		text.WriteString(fmt.Sprintf("\n- %s `%s`", change.Action, change.Email))
+	}
+	return text.String()
+}
+
+// executeSyncCommand handles `/parabol sync ...` for the linked current channel.
+func (p *Plugin) executeSyncCommand(args *model.CommandArgs, fields []string) *model.CommandResponse {
+	const usage = "Usage: `/parabol sync status`, `/parabol sync mode <off|auto|approval>`, `/parabol sync dry-run` " +
+		"or `/parabol sync approve|reject <email|all>`"
+	if len(fields) == 0 {
+		return ephemeralResponse(usage)
+	}
+	channel, appErr := p.API.GetChannel(args.ChannelId)
+	if appErr != nil {
+		return ephemeralResponse("Failed to get the channel.")
+	}
+	if !p.canManageChannel(args.UserId, channel) {
+		return ephemeralResponse("You need permission to manage this channel to sync its members.")
+	}
+	link, err := p.getChannelLink(channel.Id)
+	if err != nil {
+		p.API.LogError("Failed to read channel link", "channel_id", channel.Id, "err", err.Error())
+		return ephemeralResponse("Failed to read the channel link.")
+	}
+	if link == nil {
+		return ephemeralResponse("This channel isn't linked to a Parabol team, link it in the integration settings of the team in Parabol.")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+
+	switch fields[0] {
+	case "status":
+		mode := link.SyncMode
+		if mode == "" {
+			mode = syncModeOff
+		}
+		text := fmt.Sprintf("This channel is linked to the Parabol team %s, membership sync is `%s`.", link.TeamName, mode)
+		pending, err := p.getPendingSync(channel.Id)
+		if err != nil {
+			p.API.LogWarn("Failed to read pending changes", "channel_id", channel.Id, "err", err.Error())
+		}
+		if pending != nil && len(pending.Changes) > 0 {
+			changes := make([]membershipChange, 0, len(pending.Changes))
+			for _, change := range pending.Changes {
+				changes = append(changes, change)
+			}
+			text += "\n\nChanges waiting for approval:" + formatChanges(changes)
+		}
+		return ephemeralResponse(text)
+
+	case "mode":
+		if len(fields) != 2 || (fields[1] != syncModeOff && fields[1] != syncModeAuto && fields[1] != syncModeApproval) {
+			return ephemeralResponse(usage)
+		}
+		found, err := p.updateChannelLink(channel.Id, func(stored *channelLink) {
+			stored.SyncMode = fields[1]
+			link = stored
+		})
+		if err != nil {
+			p.API.LogError("Failed to store channel link", "channel_id", channel.Id, "err", err.Error())
+			return ephemeralResponse("Failed to update the sync mode.")
+		}
+		if !found {
+			return ephemeralResponse("This channel was unlinked from its Parabol team.")
+		}
+		p.audit(nil, auditRecord{
+			ActorID: args.UserId,
+			Action:  auditActionSyncMode,
+			Target:  channel.Id,
+			Outcome: auditOutcomeSuccess,
+			Details: map[string]string{"mode": link.SyncMode},
+		})
+		return ephemeralResponse(fmt.Sprintf("Membership sync is now `%s`. Run `/parabol sync dry-run` to see what the next reconciliation changes.", link.SyncMode))
+
+	case "dry-run":
+		changes, err := p.membershipDiff(ctx, link)
+		if err != nil {
+			p.API.LogWarn("Failed to compare channel membership", "channel_id", channel.Id, "err", err.Error())
+			return ephemeralResponse("Failed to get the members of the Parabol team.")
+		}
+		if len(changes) == 0 {
+			return ephemeralResponse("The channel and the Parabol team have the same members.")
+		}
+		return ephemeralResponse("A sync would make these changes, nothing was changed:" + formatChanges(changes))
+
+	case "approve", "reject":
+		if len(fields) != 2 {
+			return ephemeralResponse(usage)
+		}
+		var selected []membershipChange
+		if _, err := p.updatePendingSync(channel.Id, func(pending *pendingSync) {
+			selected = selected[:0]
+			for email, change := range pending.Changes {
+				if fields[1] != "all" && !strings.EqualFold(fields[1], email) {
+					continue
+				}
+				selected = append(selected, change)
+				delete(pending.Changes, email)
+				if fields[0] == "reject" {
+					pending.Rejected[email] = change.Action
+				}
+			}
+		}); err != nil {
+			p.API.LogError("Failed to update pending changes", "channel_id", channel.Id, "err", err.Error())
+			return ephemeralResponse("Failed to update the pending changes.")
+		}
+		if len(selected) == 0 {
+			return ephemeralResponse("No matching changes are waiting for approval.")
+		}
+		if fields[0] == "reject" {
+			return ephemeralResponse("Rejected:" + formatChanges(selected))
+		}
+		if err := p.applyMembershipChanges(ctx, link, args.UserId, selected); err != nil {
+			p.API.LogWarn("Failed to apply membership changes", "channel_id", channel.Id, "err", err.Error())
+			if _, err := p.updatePendingSync(channel.Id, func(pending *pendingSync) {
+				for _, change := range selected {
+					pending.Changes[change.Email] = change
+				}
+			}); err != nil {
+				p.API.LogError("Failed to restore pending changes", "channel_id", channel.Id, "err", err.Error())
+			}
+			return ephemeralResponse("Parabol couldn't apply the changes, they are still waiting for approval.")
+		}
+		return ephemeralResponse("Applied:" + formatChanges(selected))
+
+	default:
+		return ephemeralResponse(usage)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMembershipChanges(t *testing.T) {
+	const now = 1760864400000
+	alice := &model.User{Id: "alice", Email: "Alice@example.com"}
+	bob := &model.User{Id: "bob", Email: "bob@example.com"}
+	carol := &model.User{Id: "carol", Email: "carol@example.com"}
+	bot := &model.User{Id: "bot", Email: "bot@example.com", IsBot: true}
+	mattermostUsers := map[string]*model.User{
+		"alice@example.com": alice,
+		"bob@example.com":   bob,
+		"carol@example.com": carol,
+		"bot@example.com":   bot,
+	}
+
+	for name, tc := range map[string]struct {
+		channel []*model.User
+		team    []string
+		expect  []membershipChange
+	}{
+		"in sync": {
+			channel: []*model.User{alice, bob},
+			team:    []string{"alice@example.com", "bob@example.com"},
+		},
+		"emails are compared case-insensitively": {
+			channel: []*model.User{alice},
+			team:    []string{"ALICE@example.com"},
+		},
+		"new channel members are invited": {
+			channel: []*model.User{alice, bob},
+			team:    []string{"alice@example.com"},
+			expect: []membershipChange{
+				{Email: "bob@example.com", UserID: "bob", Action: syncActionInvite, RequestedAt: now},
+			},
+		},
+		"former channel members are removed": {
+			channel: []*model.User{alice},
+			team:    []string{"carol@example.com", "alice@example.com", "bob@example.com"},
+			expect: []membershipChange{
+				{Email: "bob@example.com", UserID: "bob", Action: syncActionRemove, RequestedAt: now},
+				{Email: "carol@example.com", UserID: "carol", Action: syncActionRemove, RequestedAt: now},
+			},
+		},
+		"guests and bots are left in the team": {
+			channel: []*model.User{alice},
+			team:    []string{"alice@example.com", "guest@outside.example", "bot@example.com"},
+		},
+		"invites come before removals": {
+			channel: []*model.User{bob},
+			team:    []string{"alice@example.com"},
+			expect: []membershipChange{
+				{Email: "bob@example.com", UserID: "bob", Action: syncActionInvite, RequestedAt: now},
+				{Email: "alice@example.com", UserID: "alice", Action: syncActionRemove, RequestedAt: now},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			changes := membershipChanges(tc.channel, tc.team, func(email string) *model.User {
+				return mattermostUsers[email]
+			}, now)
+			assert.Equal(t, tc.expect, changes)
+		})
+	}
+}
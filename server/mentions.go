@@ -0,0 +1,202 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/pkg/errors"
+)
+
+const (
+	mentionOptOutPrefix = "mention_optout_"
+
+	// clusterEventForgetUser tells the other nodes to drop the cached mentions of a user.
+	clusterEventForgetUser = "forget_user"
+
+	// mentionCacheTTL bounds how long a changed link or opt-out may take to apply on other nodes.
+	mentionCacheTTL        = 5 * time.Minute
+	maxMentionCacheEntries = 10000
+)
+
+// mentionPlaceholder references a Parabol user by ID in the text of a notification, e.g.
+// <@local|abc123>. The users of the notification provide the email and name to fall back to.
+var mentionPlaceholder = regexp.MustCompile(`<@([^<>@\s]{1,100})>`)
+
+// mentionCacheEntry is the Mattermost user a Parabol user resolved to. UserID is empty if there
+// is none.
+type mentionCacheEntry struct {
+	userID   string
+	username string
+	optedOut bool
+	expires  time.Time
+}
+
+// mentionCache keeps resolved mentions in memory, so a notification mentioning many users or a
+// busy channel doesn't hit the user store for every mention.
+type mentionCache struct {
+	mu      sync.Mutex
+	entries map[string]mentionCacheEntry
+}
+
+func newMentionCache() *mentionCache {
+	return &mentionCache{entries: make(map[string]mentionCacheEntry)}
+}
+
+func (c *mentionCache) get(key string, now time.Time) (mentionCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || now.After(entry.expires) {
+		return mentionCacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *mentionCache) set(key string, entry mentionCacheEntry, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxMentionCacheEntries {
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= maxMentionCacheEntries {
+			c.entries = make(map[string]mentionCacheEntry)
+		}
+	}
+	entry.expires = now.Add(mentionCacheTTL)
+	c.entries[key] = entry
+}
+
+// forgetUser drops the entries of the Mattermost user, e.g. after a changed opt-out.
+func (c *mentionCache) forgetUser(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if entry.userID == userID {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// forgetUser drops the cached mentions of the user on every node of the cluster.
+func (p *Plugin) forgetUser(userID string) {
+	p.mentionCache.forgetUser(userID)
+	if err := p.API.PublishPluginClusterEvent(model.PluginClusterEvent{
+		Id:   clusterEventForgetUser,
+		Data: []byte(userID),
+	}, model.PluginClusterEventSendOptions{
+		SendType: model.PluginClusterEventSendTypeReliable,
+	}); err != nil {
+		p.API.LogWarn("Failed to tell the other nodes to forget a user", "user_id", userID, "err", err.Error())
+	}
+}
+
+// OnPluginClusterEvent handles the events published by other nodes.
+func (p *Plugin) OnPluginClusterEvent(_ *plugin.Context, event model.PluginClusterEvent) {
+	if event.Id == clusterEventForgetUser {
+		p.mentionCache.forgetUser(string(event.Data))
+	}
+}
+
+// resolveMention returns the Mattermost user linked to the Parabol user of the connection, by the
+// identity mapping or by email, and whether they opted out of mentions.
+func (p *Plugin) resolveMention(connection *parabolConnection, user *parabolUser) (mentionCacheEntry, error) {
+	key := connection.Name + "\n" + user.UserID + "\n" + user.Email
+	now := time.Now()
+	entry, ok := p.mentionCache.get(key, now)
+	p.metrics.cacheLookup("mention", ok)
+	if ok {
+		return entry, nil
+	}
+
+	// Mentions only read the identity links, an email in a notification mustn't create one.
+	linked, _, err := p.lookupUser(connection, user.UserID, user.Email)
+	switch {
+	case err == errUnknownUser:
+		// Unknown users are cached as well, they are the common case for guests of a meeting.
+	case err != nil:
+		return mentionCacheEntry{}, err
+	default:
+		entry.userID = linked.Id
+		entry.username = linked.Username
+		if entry.optedOut, err = p.isMentionOptedOut(linked.Id); err != nil {
+			return mentionCacheEntry{}, err
+		}
+	}
+	p.mentionCache.set(key, entry, now)
+	return entry, nil
+}
+
+// mentionsFor returns the function mentioning users of the connection: the @mention of the
+// Mattermost user linked to the Parabol user, or the name as plain text if there is none or they
+// opted out.
+func (p *Plugin) mentionsFor(connection *parabolConnection) func(*parabolUser) string {
+	return func(user *parabolUser) string {
+		entry, err := p.resolveMention(connection, user)
+		if err != nil {
+			p.API.LogWarn("Failed to resolve Parabol user", "parabol_user_id", user.UserID, "connection", connection.Name, "err", err.Error())
+		}
+		if entry.userID != "" && !entry.optedOut {
+			return "@" + entry.username
+		}
+		if user.Name == "" {
+			return "someone"
+		}
+		return summaryText(user.Name)
+	}
+}
+
+func (p *Plugin) isMentionOptedOut(userID string) (bool, error) {
+	value, appErr := p.API.KVGet(mentionOptOutPrefix + userID)
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to read mention preference")
+	}
+	return value != nil, nil
+}
+
+// setMentionOptOut stores whether Parabol may @mention the user. It applies immediately on this
+// node and within mentionCacheTTL on the others.
+func (p *Plugin) setMentionOptOut(userID string, optOut bool) error {
+	defer p.mentionCache.forgetUser(userID)
+	if !optOut {
+		if appErr := p.API.KVDelete(mentionOptOutPrefix + userID); appErr != nil {
+			return errors.Wrap(appErr, "failed to delete mention preference")
+		}
+		return nil
+	}
+	if appErr := p.API.KVSet(mentionOptOutPrefix+userID, []byte("true")); appErr != nil {
+		return errors.Wrap(appErr, "failed to store mention preference")
+	}
+	return nil
+}
+
+// resolveMentions replaces the <@id> placeholders in the texts of the notification using mention.
+func (n *notification) resolveMentions(mention func(*parabolUser) string) {
+	replace := func(text string) string {
+		return mentionPlaceholder.ReplaceAllStringFunc(text, func(placeholder string) string {
+			id := mentionPlaceholder.FindStringSubmatch(placeholder)[1]
+			user := parabolUser{UserID: id}
+			if known, ok := n.Users[id]; ok && known != nil {
+				user.Email = known.Email
+				user.Name = known.Name
+			}
+			return mention(&user)
+		})
+	}
+	n.Message = replace(n.Message)
+	n.Card = replace(n.Card)
+	for _, attachment := range n.Attachments {
+		attachment.Pretext = replace(attachment.Pretext)
+		attachment.Text = replace(attachment.Text)
+		for _, field := range attachment.Fields {
+			if value, ok := field.Value.(string); ok {
+				field.Value = replace(value)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMentionCache(t *testing.T) {
+	start := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	alice := mentionCacheEntry{userID: "u1", username: "alice"}
+
+	for name, tc := range map[string]struct {
+		// fill stores as many other entries before alice, at the given age.
+		fill        int
+		fillAge     time.Duration
+		at          time.Duration
+		forget      string
+		expectFound bool
+		expectSize  int
+	}{
+		"fresh entry": {
+			at:          mentionCacheTTL - time.Second,
+			expectFound: true,
+			expectSize:  1,
+		},
+		"expired entry": {
+			at:         mentionCacheTTL + time.Second,
+			expectSize: 1,
+		},
+		"forgotten user": {
+			forget:     "u1",
+			expectSize: 0,
+		},
+		"other user forgotten": {
+			forget:      "u2",
+			expectFound: true,
+			expectSize:  1,
+		},
+		"full cache drops expired entries": {
+			fill:        maxMentionCacheEntries,
+			fillAge:     mentionCacheTTL + time.Second,
+			expectFound: true,
+			expectSize:  1,
+		},
+		"full cache of live entries is cleared": {
+			fill:        maxMentionCacheEntries,
+			fillAge:     time.Second,
+			expectFound: true,
+			expectSize:  1,
+		},
+		"cache below the limit keeps expired entries": {
+			fill:        maxMentionCacheEntries - 1,
+			fillAge:     mentionCacheTTL + time.Second,
+			expectFound: true,
+			expectSize:  maxMentionCacheEntries,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cache := newMentionCache()
+			for i := range tc.fill {
+				cache.set("other\n"+strconv.Itoa(i), mentionCacheEntry{userID: "u2"}, start.Add(-tc.fillAge))
+			}
+			cache.set("default\nparabol-alice\nalice@example.com", alice, start)
+			if tc.forget != "" {
+				cache.forgetUser(tc.forget)
+			}
+
+			entry, found := cache.get("default\nparabol-alice\nalice@example.com", start.Add(tc.at))
+			assert.Equal(t, tc.expectFound, found)
+			if tc.expectFound {
+				assert.Equal(t, "alice", entry.username)
+			}
+			assert.Len(t, cache.entries, tc.expectSize)
+		})
+	}
+}
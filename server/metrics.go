@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metrics collects the plugin's metrics in memory and renders them in the Prometheus text
+// exposition format. The values are per plugin process and reset when the plugin restarts.
+type metrics struct {
+	lock       sync.Mutex
+	counters   map[string]*counterVec
+	histograms map[string]*histogramVec
+}
+
+type counterVec struct {
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+type histogramVec struct {
+	help   string
+	labels []string
+	values map[string]*histogram
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// Metric names.
+const (
+	metricHTTPRequests       = "parabol_http_requests_total"
+	metricHTTPDuration       = "parabol_http_request_duration_seconds"
+	metricUpstreamResponses  = "parabol_upstream_responses_total"
+	metricUpstreamDuration   = "parabol_upstream_request_duration_seconds"
+	metricNotifications      = "parabol_notifications_total"
+	metricSignatureFailures  = "parabol_signature_failures_total"
+	metricCommandInvocations = "parabol_command_invocations_total"
+	metricCacheRequests      = "parabol_cache_requests_total"
+	metricRateLimited        = "parabol_rate_limited_total"
+)
+
+func newMetrics() *metrics {
+	m := &metrics{
+		counters:   make(map[string]*counterVec),
+		histograms: make(map[string]*histogramVec),
+	}
+	m.registerCounter(metricHTTPRequests, "Requests handled by the plugin routes.", "route", "method", "status")
+	m.registerHistogram(metricHTTPDuration, "Latency of the plugin routes.", "route", "method")
+	m.registerCounter(metricUpstreamResponses, "Responses of Parabol to signed requests, status is error if no response was received.", "connection", "status")
+	m.registerHistogram(metricUpstreamDuration, "Latency of signed requests to Parabol.", "connection")
+	m.registerCounter(metricNotifications, "Notifications from Parabol by result: rejected, queued, muted, created, failed (retried) or dead_lettered.", "result")
+	m.registerCounter(metricSignatureFailures, "Requests from Parabol with an invalid signature.", "connection")
+	m.registerCounter(metricCommandInvocations, "Slash command invocations.", "command")
+	m.registerCounter(metricCacheRequests, "Cache lookups.", "cache", "result")
+	m.registerCounter(metricRateLimited, "Requests rejected by the rate limits.", "route", "scope")
+	return m
+}
+
+func (m *metrics) registerCounter(name, help string, labels ...string) {
+	m.counters[name] = &counterVec{help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (m *metrics) registerHistogram(name, help string, labels ...string) {
+	m.histograms[name] = &histogramVec{help: help, labels: labels, values: make(map[string]*histogram)}
+}
+
+// labelKey joins the label values, it is split again when rendering.
+func labelKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+// inc increments the counter with the given label values, which must match the registered labels.
+func (m *metrics) inc(name string, labelValues ...string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if counter, ok := m.counters[name]; ok && len(labelValues) == len(counter.labels) {
+		counter.values[labelKey(labelValues)]++
+	}
+}
+
+// observe records a duration in the histogram with the given label values.
+func (m *metrics) observe(name string, duration time.Duration, labelValues ...string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	vec, ok := m.histograms[name]
+	if !ok || len(labelValues) != len(vec.labels) {
+		return
+	}
+	key := labelKey(labelValues)
+	h, ok := vec.values[key]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		vec.values[key] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// cacheLookup records a hit or miss of the named cache.
+func (m *metrics) cacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.inc(metricCacheRequests, cache, result)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i])))
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeTo renders all metrics in the Prometheus text exposition format.
+func (m *metrics) writeTo(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, name := range sortedKeys(m.counters) {
+		counter := m.counters[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, counter.help, name)
+		for _, key := range sortedKeys(counter.values) {
+			fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(counter.labels, strings.Split(key, "\x00")), formatFloat(counter.values[key]))
+		}
+	}
+
+	for _, name := range sortedKeys(m.histograms) {
+		vec := m.histograms[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, vec.help, name)
+		for _, key := range sortedKeys(vec.values) {
+			h := vec.values[key]
+			values := strings.Split(key, "\x00")
+			for i, bound := range latencyBuckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(vec.labels, values, fmt.Sprintf(`le="%s"`, formatFloat(bound))), h.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(vec.labels, values, `le="+Inf"`), h.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(vec.labels, values), formatFloat(h.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(vec.labels, values), h.count)
+		}
+	}
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps streaming responses working through the recorder.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// withMetrics is the router middleware counting requests and their latency per route template.
+func (p *Plugin) withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		p.metrics.inc(metricHTTPRequests, route, r.Method, strconv.Itoa(recorder.status))
+		p.metrics.observe(metricHTTPDuration, time.Since(start), route, r.Method)
+	})
+}
+
+// instrumentedTransport records the status codes and latency of requests to Parabol.
+type instrumentedTransport struct {
+	connection string
+	metrics    *metrics
+	next       http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	t.metrics.observe(metricUpstreamDuration, time.Since(start), t.connection)
+	if err != nil {
+		t.metrics.inc(metricUpstreamResponses, t.connection, "error")
+		return nil, err
+	}
+	t.metrics.inc(metricUpstreamResponses, t.connection, strconv.Itoa(res.StatusCode))
+	return res, nil
+}
+
+// transport returns the round tripper for requests to the given connection.
+func (m *metrics) transport(connection string) http.RoundTripper {
+	return &instrumentedTransport{
+		connection: connection,
+		metrics:    m,
+		next:       http.DefaultTransport,
+	}
+}
+
+// serveMetrics renders the metrics for system admins.
+func (p *Plugin) serveMetrics(c *Context, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.metrics.writeTo(w)
+}
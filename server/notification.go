@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+// Limits of a notification, well below what Mattermost accepts for a post so a notification never
+// fails to post because of its size.
+const (
+	maxNotificationLength  = 256 << 10
+	maxMessageLength       = model.PostMessageMaxRunesV2
+	maxCardLength          = model.PostMessageMaxRunesV2
+	maxAttachments         = 10
+	maxAttachmentText      = 8000
+	maxAttachmentShortText = 256
+	maxAttachmentFields    = 20
+	maxFieldValueLength    = 2000
+	maxActions             = 5
+	maxActionNameLength    = 64
+	maxActionValueLength   = 1024
+	maxNotificationUsers   = 100
+)
+
+// allowedPostProps are the only props a notification may set on a post. Props like from_webhook
+// or override_username must never be controlled by Parabol.
+var allowedPostProps = map[string]bool{
+	"attachments": true,
+	"card":        true,
+	postTypeProp:  true,
+}
+
+var (
+	hexColor      = regexp.MustCompile(`^#(?:[0-9a-fA-F]{3}){1,2}$`)
+	validActionID = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+)
+
+// buttonStyles are the styles Mattermost supports for buttons, besides hex colors.
+var buttonStyles = map[string]bool{
+	"":        true,
+	"default": true,
+	"primary": true,
+	"success": true,
+	"good":    true,
+	"warning": true,
+	"danger":  true,
+}
+
+// notification is the payload Parabol sends to be posted. At least one of Message, Attachments
+// or Card must be set.
+type notification struct {
+	// Message is the Markdown text of the post.
+	Message string `json:"message,omitempty"`
+	// Attachments are rendered below the message. Interactive actions aren't allowed inside
+	// attachments, use Actions instead.
+	Attachments []*model.SlackAttachment `json:"attachments,omitempty"`
+	// Card is Markdown shown in the right hand sidebar when the post is opened.
+	Card string `json:"card,omitempty"`
+	// Actions are links or buttons shown below the message.
+	Actions []*notificationAction `json:"actions,omitempty"`
+	// Type is a custom_parabol_* post type rendered by a dedicated component, with Data matching
+	// the versioned schema of the type. Message is the plain text fallback.
+	Type string         `json:"type,omitempty"`
+	Data map[string]any `json:"data,omitempty"`
+	// Vote makes reactions on the post count as votes in Parabol, see forwardVote.
+	Vote *notificationVote `json:"vote,omitempty"`
+	// Users are the Parabol users mentioned as <@id> in the texts, by their Parabol user ID.
+	Users map[string]*parabolUser `json:"users,omitempty"`
+}
+
+// notificationAction is either a link, if URL is set, or a button calling back Parabol with ID
+// and Value when clicked, see handleAction.
+type notificationAction struct {
+	Name  string `json:"name"`
+	URL   string `json:"url,omitempty"`
+	ID    string `json:"id,omitempty"`
+	Value string `json:"value,omitempty"`
+	Style string `json:"style,omitempty"`
+}
+
+func (a *notificationAction) isButton() bool {
+	return a.ID != ""
+}
+
+// validationError is a problem with the notification which is reported back to Parabol as is.
+type validationError struct {
+	message string
+}
+
+func (e *validationError) Error() string {
+	return e.message
+}
+
+func invalid(format string, args ...any) error {
+	return &validationError{message: fmt.Sprintf(format, args...)}
+}
+
+// parseNotification decodes and validates a notification. Unknown fields are rejected.
+func parseNotification(r io.Reader) (*notification, error) {
+	raw, err := io.ReadAll(io.LimitReader(r, maxNotificationLength+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read notification")
+	}
+	if len(raw) > maxNotificationLength {
+		return nil, invalid("notification is larger than %d bytes", maxNotificationLength)
+	}
+	return decodeNotification(raw)
+}
+
+// decodeNotification decodes and validates a notification embedded in another request.
+func decodeNotification(raw []byte) (*notification, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, invalid("notification is required")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	var n notification
+	if err := decoder.Decode(&n); err != nil {
+		return nil, invalid("notification is not valid: %s", strings.TrimPrefix(err.Error(), "json: "))
+	}
+	if decoder.More() {
+		return nil, invalid("notification is not valid: unexpected data after the notification")
+	}
+	if err := n.validate(); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func checkLength(field, value string, limit int) error {
+	if utf8.RuneCountInString(value) > limit {
+		return invalid("%s is longer than %d characters", field, limit)
+	}
+	return nil
+}
+
+func checkURL(field, value string) error {
+	if value != "" && !model.IsValidHTTPURL(value) {
+		return invalid("%s is not a valid http(s) URL", field)
+	}
+	return nil
+}
+
+func (n *notification) validate() error {
+	if n.Message == "" && len(n.Attachments) == 0 && n.Card == "" {
+		return invalid("notification needs a message, attachments or a card")
+	}
+	if err := checkLength("message", n.Message, maxMessageLength); err != nil {
+		return err
+	}
+	if err := checkLength("card", n.Card, maxCardLength); err != nil {
+		return err
+	}
+	if len(n.Attachments) > maxAttachments {
+		return invalid("notification has more than %d attachments", maxAttachments)
+	}
+	for i, attachment := range n.Attachments {
+		if err := validateAttachment(fmt.Sprintf("attachments[%d]", i), attachment); err != nil {
+			return err
+		}
+	}
+	if err := n.validatePostType(); err != nil {
+		return err
+	}
+	if n.Vote != nil {
+		if err := n.Vote.validate(); err != nil {
+			return err
+		}
+	}
+	if len(n.Users) > maxNotificationUsers {
+		return invalid("notification has more than %d users", maxNotificationUsers)
+	}
+	for _, id := range sortedKeys(n.Users) {
+		if n.Users[id] == nil || !mentionPlaceholder.MatchString("<@"+id+">") {
+			return invalid("users.%s is not a valid user", id)
+		}
+		if err := checkLength("users."+id+".name", n.Users[id].Name, maxAttachmentShortText); err != nil {
+			return err
+		}
+	}
+	if len(n.Actions) > maxActions {
+		return invalid("notification has more than %d actions", maxActions)
+	}
+	for i, action := range n.Actions {
+		field := fmt.Sprintf("actions[%d]", i)
+		if action == nil || action.Name == "" {
+			return invalid("%s.name is required", field)
+		}
+		if err := checkLength(field+".name", action.Name, maxActionNameLength); err != nil {
+			return err
+		}
+		if (action.URL == "") == (action.ID == "") {
+			return invalid("%s needs either a url or an id", field)
+		}
+		if !action.isButton() {
+			if err := checkURL(field+".url", action.URL); err != nil {
+				return err
+			}
+			continue
+		}
+		if !validActionID.MatchString(action.ID) {
+			return invalid("%s.id may only contain letters, digits, '_', '.' and '-'", field)
+		}
+		if err := checkLength(field+".value", action.Value, maxActionValueLength); err != nil {
+			return err
+		}
+		if !buttonStyles[action.Style] && !hexColor.MatchString(action.Style) {
+			return invalid("%s.style must be default, primary, success, good, warning, danger or a hex color", field)
+		}
+	}
+	return nil
+}
+
+func validateAttachment(field string, attachment *model.SlackAttachment) error {
+	if attachment == nil {
+		return invalid("%s must not be null", field)
+	}
+	if len(attachment.Actions) > 0 {
+		return invalid("%s.actions are not allowed, use the actions of the notification", field)
+	}
+	if attachment.Color != "" && attachment.Color != "good" && attachment.Color != "warning" && attachment.Color != "danger" && !hexColor.MatchString(attachment.Color) {
+		return invalid("%s.color must be good, warning, danger or a hex color", field)
+	}
+	for _, text := range []struct{ name, value string }{
+		{"fallback", attachment.Fallback},
+		{"pretext", attachment.Pretext},
+		{"author_name", attachment.AuthorName},
+		{"title", attachment.Title},
+		{"footer", attachment.Footer},
+	} {
+		if err := checkLength(field+"."+text.name, text.value, maxAttachmentShortText); err != nil {
+			return err
+		}
+	}
+	if err := checkLength(field+".text", attachment.Text, maxAttachmentText); err != nil {
+		return err
+	}
+	for _, link := range []struct{ name, value string }{
+		{"author_link", attachment.AuthorLink},
+		{"author_icon", attachment.AuthorIcon},
+		{"title_link", attachment.TitleLink},
+		{"image_url", attachment.ImageURL},
+		{"thumb_url", attachment.ThumbURL},
+		{"footer_icon", attachment.FooterIcon},
+	} {
+		if err := checkURL(field+"."+link.name, link.value); err != nil {
+			return err
+		}
+	}
+
+	// Timestamps are decoded as float64 but Mattermost expects an int64 or a string.
+	switch ts := attachment.Timestamp.(type) {
+	case nil, string:
+	case float64:
+		attachment.Timestamp = int64(ts)
+	default:
+		return invalid("%s.ts must be a number or a string", field)
+	}
+
+	if len(attachment.Fields) > maxAttachmentFields {
+		return invalid("%s has more than %d fields", field, maxAttachmentFields)
+	}
+	for i, attachmentField := range attachment.Fields {
+		name := fmt.Sprintf("%s.fields[%d]", field, i)
+		if attachmentField == nil {
+			return invalid("%s must not be null", name)
+		}
+		if err := checkLength(name+".title", attachmentField.Title, maxAttachmentShortText); err != nil {
+			return err
+		}
+		switch value := attachmentField.Value.(type) {
+		case nil, bool, float64:
+		case string:
+			if err := checkLength(name+".value", value, maxFieldValueLength); err != nil {
+				return err
+			}
+		default:
+			return invalid("%s.value must be a string, number or boolean", name)
+		}
+	}
+	return nil
+}
+
+// writeNotificationError rejects an invalid notification, telling Parabol what is wrong with it.
+func (p *Plugin) writeNotificationError(w http.ResponseWriter, r *http.Request, err error) {
+	p.metrics.inc(metricNotifications, "rejected")
+	var validationErr *validationError
+	if errors.As(err, &validationErr) {
+		p.writeError(w, r, http.StatusBadRequest, errCodeInvalidNotification, validationErr.Error(), nil)
+		return
+	}
+	p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Error reading body", err)
+}
+
+// toPost creates the post for the notification, without channel and user. Buttons call back the
+// given connection.
+func (n *notification) toPost(connection string) *model.Post {
+	message := n.Message
+	var links []string
+	var buttons []*model.PostAction
+	for i, action := range n.Actions {
+		if !action.isButton() {
+			links = append(links, fmt.Sprintf("[%s](%s)", escapeLinkText(action.Name), action.URL))
+			continue
+		}
+		buttons = append(buttons, &model.PostAction{
+			Id:    fmt.Sprintf("parabol%d", i),
+			Type:  model.PostActionTypeButton,
+			Name:  action.Name,
+			Style: action.Style,
+			Integration: &model.PostActionIntegration{
+				URL: "/plugins/" + manifest.Id + "/actions",
+				Context: map[string]any{
+					actionContextID:         action.ID,
+					actionContextValue:      action.Value,
+					actionContextConnection: connection,
+				},
+			},
+		})
+	}
+	if len(links) > 0 {
+		if message != "" {
+			message += "\n\n"
+		}
+		message += strings.Join(links, " · ")
+	}
+
+	post := &model.Post{Message: message, Type: n.Type}
+	if n.Type != "" {
+		post.AddProp(postTypeProp, n.Data)
+	}
+	attachments := n.Attachments
+	if len(buttons) > 0 {
+		// Buttons can only be shown in an attachment.
+		attachments = append(attachments[:len(attachments):len(attachments)], &model.SlackAttachment{Actions: buttons})
+	}
+	if len(attachments) > 0 {
+		post.AddProp("attachments", attachments)
+	}
+	if n.Card != "" {
+		post.AddProp("card", n.Card)
+	}
+	for key := range post.GetProps() {
+		if !allowedPostProps[key] {
+			post.DelProp(key)
+		}
+	}
+	return post
+}
+
+// escapeLinkText keeps an action name from breaking out of the Markdown link.
+func escapeLinkText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`).Replace(text)
+}
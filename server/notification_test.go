@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// testMention resolves Parabol users in tests, only Bob is linked to a Mattermost user.
+func testMention(user *parabolUser) string {
+	if user.UserID == "parabol-bob" || user.Email == "bob@example.com" {
+		return "@bob"
+	}
+	if user.Name == "" {
+		return "someone"
+	}
+	return summaryText(user.Name)
+}
+
+// TestNotificationGolden parses every notification in testdata/notifications and compares the
+// resulting post, or the validation error, with the .golden file next to it.
+func TestNotificationGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "notifications", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no test notifications found")
+	}
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".json")
+		t.Run(name, func(t *testing.T) {
+			raw, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []byte
+			n, err := parseNotification(bytes.NewReader(raw))
+			if err != nil {
+				got = []byte("error: " + err.Error() + "\n")
+			} else {
+				n.resolveMentions(testMention)
+				post := n.toPost(defaultConnectionName)
+				if got, err = json.MarshalIndent(struct {
+					Type    string         `json:"type,omitempty"`
+					Message string         `json:"message"`
+					Props   map[string]any `json:"props"`
+				}{post.Type, post.Message, post.GetProps()}, "", "  "); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, '\n')
+			}
+
+			golden := strings.TrimSuffix(input, ".json") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, got, 0o600); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("missing golden file, run go test -update: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("unexpected result for %s\ngot:\n%s\nwant:\n%s", input, got, want)
+			}
+		})
+	}
+}
+
+func TestNotificationLimits(t *testing.T) {
+	for name, tc := range map[string]struct {
+		notification string
+		expectError  string
+	}{
+		"message at the limit": {
+			notification: `{"message": "` + strings.Repeat("a", maxMessageLength) + `"}`,
+		},
+		"message too long": {
+			notification: `{"message": "` + strings.Repeat("a", maxMessageLength+1) + `"}`,
+			expectError:  "message is longer than 16383 characters",
+		},
+		"attachment text too long": {
+			notification: `{"attachments": [{"text": "` + strings.Repeat("ä", maxAttachmentText+1) + `"}]}`,
+			expectError:  "attachments[0].text is longer than 8000 characters",
+		},
+		"notification too large": {
+			notification: `{"message": "` + strings.Repeat(" ", maxNotificationLength) + `"}`,
+			expectError:  "notification is larger than 262144 bytes",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseNotification(strings.NewReader(tc.notification))
+			if tc.expectError == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.expectError != "" && (err == nil || err.Error() != tc.expectError) {
+				t.Fatalf("expected error %q, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+const (
+	maxBatchTargets    = 100
+	maxBatchBodyLength = 4 << 20
+)
+
+// batchTarget is a single notification of a batch. The notification defaults to the one of the
+// batch.
+type batchTarget struct {
+	ChannelID    string          `json:"channelId"`
+	Notification json.RawMessage `json:"notification,omitempty"`
+}
+
+type batchRequest struct {
+	Notification json.RawMessage `json:"notification,omitempty"`
+	Targets      []batchTarget   `json:"targets"`
+}
+
+// batchResult reports the outcome of one target. Status is queued once the notification is in the
+// outbox, or failed, in which case Code and Error are set.
+type batchResult struct {
+	ChannelID string `json:"channelId"`
+	ID        string `json:"id,omitempty"`
+	Status    string `json:"status"`
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// notifyBatch queues notifications to many channels in a single signed request. All channels must
+// be served by the connection whose key signed the request. Each target gets its own result, a
+// failing target doesn't fail the others.
+func (p *Plugin) notifyBatch(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > maxBatchBodyLength {
+		p.writeError(w, r, http.StatusRequestEntityTooLarge, errCodeBadRequest, "Body too large", nil)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBodyLength)
+	connection := p.verifyAnyNotification(w, r, "batch")
+	if connection == nil {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Error reading body", err)
+		return
+	}
+	var batch batchRequest
+	if err := json.Unmarshal(body, &batch); err != nil {
+		p.metrics.inc(metricNotifications, "rejected")
+		p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Error parsing body", err)
+		return
+	}
+	if len(batch.Targets) == 0 || len(batch.Targets) > maxBatchTargets {
+		p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, fmt.Sprintf("A batch needs between 1 and %d targets", maxBatchTargets), nil)
+		return
+	}
+
+	connections := make([]*parabolConnection, len(batch.Targets))
+	for i, target := range batch.Targets {
+		if model.IsValidId(target.ChannelID) {
+			connections[i], _ = p.connectionForChannel(target.ChannelID)
+		}
+	}
+
+	results := make([]batchResult, len(batch.Targets))
+	queued := false
+	for i, target := range batch.Targets {
+		results[i] = batchResult{ChannelID: target.ChannelID, Status: "failed"}
+		switch {
+		case !model.IsValidId(target.ChannelID):
+			results[i].Code, results[i].Error = errCodeBadRequest, "Invalid channel ID"
+			continue
+		case connections[i] != connection:
+			results[i].Code, results[i].Error = errCodeNoConnection, "Channel is not served by the signing connection"
+			continue
+		case p.channelArchived(target.ChannelID):
+			results[i].Code, results[i].Error = errCodeChannelArchived, "Channel is archived"
+			continue
+		}
+		raw := target.Notification
+		if len(raw) == 0 {
+			raw = batch.Notification
+		}
+		n, err := decodeNotification(raw)
+		if err != nil {
+			p.metrics.inc(metricNotifications, "rejected")
+			results[i].Code, results[i].Error = errCodeInvalidNotification, err.Error()
+			continue
+		}
+
+		// The outbox posts the notifications, under its lock, so none is posted twice.
+		item := p.newOutboxItem(target.ChannelID, connection, n)
+		if err := p.storeNotification(item); err != nil {
+			p.API.LogError("Failed to queue notification", "channel_id", target.ChannelID, "err", err.Error())
+			results[i].Code, results[i].Error = errCodeInternal, "Error queueing notification"
+			continue
+		}
+		p.metrics.inc(metricNotifications, "queued")
+		results[i].ID, results[i].Status = item.ID, outboxRetrying
+		queued = true
+	}
+	if queued {
+		go p.processOutbox()
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Results []batchResult `json:"results"`
+	}{
+		Results: results,
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const batchURL = "http://mattermost.test/plugins/co.parabol.action/notify"
+
+func TestNotifyBatch(t *testing.T) {
+	const otherToken = "7e2a9c4f1b8d3e6a0c5f2b9d4e7a1c8f3b6d0e5a2c9f4b7e1d8a3c6f0b5e2d9a"
+	teamID, otherTeamID := model.NewId(), model.NewId()
+	channelID, archivedID, otherChannelID := model.NewId(), model.NewId(), model.NewId()
+
+	manyTargets := make([]string, maxBatchTargets+1)
+	for i := range manyTargets {
+		manyTargets[i] = fmt.Sprintf(`{"channelId": %q}`, channelID)
+	}
+
+	for name, tc := range map[string]struct {
+		body          string
+		signingToken  string
+		expectStatus  int
+		expectError   string
+		expectResults []batchResult
+	}{
+		"unsigned": {
+			body:         fmt.Sprintf(`{"notification": {"message": "hello"}, "targets": [{"channelId": %q}]}`, channelID),
+			expectStatus: http.StatusUnauthorized,
+			expectError:  errCodeInvalidSignature,
+		},
+		"no targets": {
+			body:         `{"notification": {"message": "hello"}, "targets": []}`,
+			signingToken: testToken,
+			expectStatus: http.StatusBadRequest,
+			expectError:  errCodeBadRequest,
+		},
+		"too many targets": {
+			body:         `{"notification": {"message": "hello"}, "targets": [` + strings.Join(manyTargets, ",") + `]}`,
+			signingToken: testToken,
+			expectStatus: http.StatusBadRequest,
+			expectError:  errCodeBadRequest,
+		},
+		"every target gets a result": {
+			body: fmt.Sprintf(`{"notification": {"message": "hello"}, "targets": [
+				{"channelId": %q},
+				{"channelId": %q},
+				{"channelId": %q},
+				{"channelId": "invalid"},
+				{"channelId": %q, "notification": {}}
+			]}`, channelID, archivedID, otherChannelID, channelID),
+			signingToken: testToken,
+			expectStatus: http.StatusOK,
+			expectResults: []batchResult{
+				{ChannelID: channelID, Status: outboxRetrying},
+				{ChannelID: archivedID, Status: "failed", Code: errCodeChannelArchived},
+				{ChannelID: otherChannelID, Status: "failed", Code: errCodeNoConnection},
+				{ChannelID: "invalid", Status: "failed", Code: errCodeBadRequest},
+				{ChannelID: channelID, Status: "failed", Code: errCodeInvalidNotification},
+			},
+		},
+		"channels of the other connection": {
+			body:         fmt.Sprintf(`{"notification": {"message": "hello"}, "targets": [{"channelId": %q}, {"channelId": %q}]}`, channelID, otherChannelID),
+			signingToken: otherToken,
+			expectStatus: http.StatusOK,
+			expectResults: []batchResult{
+				{ChannelID: channelID, Status: "failed", Code: errCodeNoConnection},
+				{ChannelID: otherChannelID, Status: outboxRetrying},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := newTestAPI()
+			// Keep the notifications queued, so the outbox can be checked.
+			api.postErr = model.NewAppError("CreatePost", "app.post.save.app_error", nil, "", http.StatusInternalServerError)
+			api.channels[channelID] = &model.Channel{Id: channelID, TeamId: teamID}
+			api.channels[archivedID] = &model.Channel{Id: archivedID, TeamId: teamID, DeleteAt: 1}
+			api.channels[otherChannelID] = &model.Channel{Id: otherChannelID, TeamId: otherTeamID}
+			p := newTestPlugin(api)
+
+			connections := []*parabolConnection{
+				{Name: "default", URL: "https://parabol.test", Token: testToken, Teams: []string{teamID}},
+				{Name: "other", URL: "https://other.parabol.test", Token: otherToken, Teams: []string{otherTeamID}},
+			}
+			for _, connection := range connections {
+				require.NoError(t, connection.IsValid(false))
+			}
+			p.setConfiguration(&configuration{connections: connections})
+
+			var req *http.Request
+			if tc.signingToken == "" {
+				req = httptest.NewRequest(http.MethodPost, batchURL, strings.NewReader(tc.body))
+			} else {
+				signer, err := NewSigner(algHS256, []byte(tc.signingToken), "")
+				require.NoError(t, err)
+				req = signRequestAsParabol(t, signer, http.MethodPost, batchURL, []byte(tc.body))
+			}
+			w := httptest.NewRecorder()
+			p.notifyBatch(w, req)
+
+			require.Equal(t, tc.expectStatus, w.Code, w.Body.String())
+			if tc.expectError != "" {
+				var response struct {
+					Code string `json:"code"`
+				}
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+				assert.Equal(t, tc.expectError, response.Code)
+				return
+			}
+
+			var response struct {
+				Results []batchResult `json:"results"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			require.Len(t, response.Results, len(tc.expectResults))
+			pending, err := p.listOutboxItems(outboxPendingPrefix)
+			require.NoError(t, err)
+			queued := make(map[string]*outboxItem, len(pending))
+			for _, item := range pending {
+				queued[item.ID] = item
+			}
+			for i, expected := range tc.expectResults {
+				result := response.Results[i]
+				assert.Equal(t, expected.ChannelID, result.ChannelID, "channel of result %d", i)
+				assert.Equal(t, expected.Status, result.Status, "status of result %d", i)
+				assert.Equal(t, expected.Code, result.Code, "code of result %d", i)
+				if expected.Status == outboxRetrying {
+					require.Contains(t, queued, result.ID, "queued notification of result %d", i)
+					assert.Equal(t, expected.ChannelID, queued[result.ID].ChannelID)
+					delete(queued, result.ID)
+				}
+			}
+			assert.Empty(t, queued, "expected only the queued results in the outbox")
+		})
+	}
+}
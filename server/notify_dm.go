@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+// dmMutePrefix marks users who don't want direct messages from the bot.
+const dmMutePrefix = "dm_mute_"
+
+// directNotification is a notification for a single user, identified by their Parabol user ID,
+// their email or both.
+type directNotification struct {
+	UserID       string          `json:"userId"`
+	Email        string          `json:"email"`
+	Notification json.RawMessage `json:"notification"`
+}
+
+// isMuted reports whether the user muted direct messages from the bot.
+func (p *Plugin) isMuted(userID string) (bool, error) {
+	raw, appErr := p.API.KVGet(dmMutePrefix + userID)
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to read mute preference")
+	}
+	return raw != nil, nil
+}
+
+// setMuted stores the mute preference of the user.
+func (p *Plugin) setMuted(userID string, muted bool) error {
+	var appErr *model.AppError
+	if muted {
+		appErr = p.API.KVSet(dmMutePrefix+userID, []byte(strconv.FormatBool(true)))
+	} else {
+		appErr = p.API.KVDelete(dmMutePrefix + userID)
+	}
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to store mute preference")
+	}
+	return nil
+}
+
+// notifyUser sends a notification as direct message from the bot. The request may be signed by any
+// connection serving a team of the user.
+func (p *Plugin) notifyUser(w http.ResponseWriter, r *http.Request) {
+	connection := p.verifyAnyNotification(w, r, "user")
+	if connection == nil {
+		return
+	}
+
+	var direct directNotification
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxNotificationLength)).Decode(&direct); err != nil {
+		p.metrics.inc(metricNotifications, "rejected")
+		p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Error parsing body", err)
+		return
+	}
+	if direct.UserID == "" && direct.Email == "" {
+		p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "userId or email is required", nil)
+		return
+	}
+	n, err := decodeNotification(direct.Notification)
+	if err != nil {
+		p.writeNotificationError(w, r, err)
+		return
+	}
+
+	// Users of teams served by another Parabol instance are unknown to this one, and aren't linked.
+	user, err := p.resolveUser(connection, direct.UserID, direct.Email)
+	if err == errUnknownUser {
+		p.writeError(w, r, http.StatusNotFound, errCodeUnknownUser, "No Mattermost user found", nil)
+		return
+	}
+	if err != nil {
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error resolving user", err)
+		return
+	}
+
+	muted, err := p.isMuted(user.Id)
+	if err != nil {
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error reading preferences", err)
+		return
+	}
+	if muted {
+		p.metrics.inc(metricNotifications, "muted")
+		writeJSON(w, http.StatusOK, struct {
+			Status string `json:"status"`
+		}{
+			Status: "muted",
+		})
+		return
+	}
+
+	botID, appErr := p.API.KVGet(botUserID)
+	if appErr != nil {
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Bot User not found", appErr)
+		return
+	}
+	channel, appErr := p.API.GetDirectChannel(user.Id, string(botID))
+	if appErr != nil {
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error opening direct message", appErr)
+		return
+	}
+
+	item := p.newOutboxItem(channel.Id, connection, n)
+	if err := p.enqueueNotification(item); err != nil {
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error queueing notification", err)
+		return
+	}
+	p.metrics.inc(metricNotifications, "queued")
+	writeJSON(w, http.StatusAccepted, struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}{
+		ID:     item.ID,
+		Status: outboxRetrying,
+	})
+}
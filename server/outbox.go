@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+)
+
+const (
+	outboxPendingPrefix = "outbox_pending_"
+	outboxDeadPrefix    = "outbox_dead_"
+	// The index keys list the IDs of the pending notifications and the dead letters.
+	outboxPendingIndexKey = "outbox_index_pending"
+	outboxDeadIndexKey    = "outbox_index_dead"
+	outboxJobKey          = "outbox_job"
+	outboxLockKey         = "outbox_lock"
+
+	// outboxInterval is how often the queue is processed, new notifications are attempted
+	// right away.
+	outboxInterval = 10 * time.Second
+	// outboxMaxAttempts is the number of failed posts after which a notification is moved to
+	// the dead letters.
+	outboxMaxAttempts = 8
+	outboxBaseBackoff = 5 * time.Second
+	outboxMaxBackoff  = time.Hour
+
+	kvListPageSize = 200
+)
+
+// Outcomes of an attempt to post a queued notification.
+const (
+	outboxDelivered    = "created"
+	outboxRetrying     = "queued"
+	outboxDeadLettered = "dead_lettered"
+)
+
+// outboxItem is a notification waiting to be posted.
+type outboxItem struct {
+	ID          string         `json:"id"`
+	ChannelID   string         `json:"channelId"`
+	Connection  string         `json:"connection"`
+	Type        string         `json:"type,omitempty"`
+	Message     string         `json:"message,omitempty"`
+	Props       map[string]any `json:"props"`
+	CreatedAt   int64          `json:"createdAt"`
+	Attempts    int            `json:"attempts"`
+	NextAttempt int64          `json:"nextAttempt"`
+	LastError   string         `json:"lastError,omitempty"`
+	// Vote is set if reactions on the post are votes.
+	Vote *notificationVote `json:"vote,omitempty"`
+}
+
+// newOutboxItem creates the queue item posting the notification to the channel. Mentions are
+// resolved now, so retries post the same text.
+func (p *Plugin) newOutboxItem(channelID string, connection *parabolConnection, n *notification) *outboxItem {
+	n.resolveMentions(p.mentionsFor(connection))
+	post := n.toPost(connection.Name)
+	return &outboxItem{
+		ChannelID:  channelID,
+		Connection: connection.Name,
+		Type:       post.Type,
+		Message:    post.Message,
+		Props:      post.GetProps(),
+		Vote:       n.Vote,
+	}
+}
+
+// outboxState is the queue as shown to admins.
+type outboxState struct {
+	Pending     []*outboxItem `json:"pending"`
+	DeadLetters []*outboxItem `json:"deadLetters"`
+}
+
+// listKeys returns all KV keys with the given prefix. It pages through every key of the plugin,
+// so it is only used to build the index of a prefix once, see readIndex.
+func (p *Plugin) listKeys(prefix string) ([]string, error) {
+	var keys []string
+	for page := 0; ; page++ {
+		pageKeys, appErr := p.API.KVList(page, kvListPageSize)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to list keys")
+		}
+		for _, key := range pageKeys {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		if len(pageKeys) < kvListPageSize {
+			return keys, nil
+		}
+	}
+}
+
+// readIndex returns the IDs listed in the index key. An index which doesn't exist yet is built
+// from the keys with the prefix, so records stored before the index was introduced are kept.
+func (p *Plugin) readIndex(indexKey, prefix string) ([]string, error) {
+	ids, _, err := p.loadIndex(indexKey, prefix)
+	return ids, err
+}
+
+// loadIndex returns the IDs of the index key along with its stored value for atomic updates.
+func (p *Plugin) loadIndex(indexKey, prefix string) ([]string, []byte, error) {
+	raw, appErr := p.API.KVGet(indexKey)
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "failed to read index")
+	}
+	if raw != nil {
+		var ids []string
+		if err := json.Unmarshal(raw, &ids); err != nil {
+			return nil, nil, errors.Wrap(err, "invalid index")
+		}
+		return ids, raw, nil
+	}
+
+	keys, err := p.listKeys(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, strings.TrimPrefix(key, prefix))
+	}
+	raw, err = json.Marshal(ids)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to serialize index")
+	}
+	// Another node may have built or changed the index in the meantime, its version wins.
+	ok, appErr := p.API.KVSetWithOptions(indexKey, raw, model.PluginKVSetOptions{Atomic: true, OldValue: nil})
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "failed to store index")
+	}
+	if !ok {
+		return p.loadIndex(indexKey, prefix)
+	}
+	return ids, raw, nil
+}
+
+// updateIndex adds the ID to or removes it from the index key.
+func (p *Plugin) updateIndex(indexKey, prefix, id string, add bool) error {
+	for range 10 {
+		ids, old, err := p.loadIndex(indexKey, prefix)
+		if err != nil {
+			return err
+		}
+		updated := make([]string, 0, len(ids)+1)
+		found := false
+		for _, existing := range ids {
+			if existing == id {
+				found = true
+				if !add {
+					continue
+				}
+			}
+			updated = append(updated, existing)
+		}
+		if found == add {
+			return nil
+		}
+		if add {
+			updated = append(updated, id)
+		}
+		raw, err := json.Marshal(updated)
+		if err != nil {
+			return errors.Wrap(err, "failed to serialize index")
+		}
+		ok, appErr := p.API.KVSetWithOptions(indexKey, raw, model.PluginKVSetOptions{Atomic: true, OldValue: old})
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to update index")
+		}
+		if ok {
+			return nil
+		}
+	}
+	return errors.New("too much contention updating index")
+}
+
+func (p *Plugin) addToIndex(indexKey, prefix, id string) error {
+	return p.updateIndex(indexKey, prefix, id, true)
+}
+
+func (p *Plugin) removeFromIndex(indexKey, prefix, id string) error {
+	return p.updateIndex(indexKey, prefix, id, false)
+}
+
+// enqueueNotification stores the notification in the outbox and triggers an attempt to post it.
+func (p *Plugin) enqueueNotification(item *outboxItem) error {
+	if err := p.storeNotification(item); err != nil {
+		return err
+	}
+	go p.processOutbox()
+	return nil
+}
+
+// storeNotification adds the notification to the outbox, to be posted by the next run. If it
+// can't be added to the index, it is removed again, since the outbox would never see it.
+func (p *Plugin) storeNotification(item *outboxItem) error {
+	item.ID = model.NewId()
+	item.CreatedAt = model.GetMillis()
+	item.NextAttempt = item.CreatedAt
+	if err := p.saveOutboxItem(outboxPendingPrefix, item); err != nil {
+		if appErr := p.API.KVDelete(outboxPendingPrefix + item.ID); appErr != nil {
+			p.API.LogWarn("Failed to remove unqueued notification", "id", item.ID, "err", appErr.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// outboxIndexKey returns the index key of the pending notifications or the dead letters.
+func outboxIndexKey(prefix string) string {
+	if prefix == outboxDeadPrefix {
+		return outboxDeadIndexKey
+	}
+	return outboxPendingIndexKey
+}
+
+func (p *Plugin) saveOutboxItem(prefix string, item *outboxItem) error {
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize notification")
+	}
+	if appErr := p.API.KVSet(prefix+item.ID, raw); appErr != nil {
+		return errors.Wrap(appErr, "failed to store notification")
+	}
+	return p.addToIndex(outboxIndexKey(prefix), prefix, item.ID)
+}
+
+func (p *Plugin) deleteOutboxItem(prefix, id string) error {
+	if appErr := p.API.KVDelete(prefix + id); appErr != nil {
+		return errors.Wrap(appErr, "failed to remove notification")
+	}
+	return p.removeFromIndex(outboxIndexKey(prefix), prefix, id)
+}
+
+func (p *Plugin) listOutboxItems(prefix string) ([]*outboxItem, error) {
+	ids, err := p.readIndex(outboxIndexKey(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*outboxItem, 0, len(ids))
+	for _, id := range ids {
+		raw, appErr := p.API.KVGet(prefix + id)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to read notification")
+		}
+		if raw == nil {
+			// The notification was removed, but not yet from the index.
+			if err := p.removeFromIndex(outboxIndexKey(prefix), prefix, id); err != nil {
+				p.API.LogWarn("Failed to remove notification from the outbox index", "id", id, "err", err.Error())
+			}
+			continue
+		}
+		var item outboxItem
+		if json.Unmarshal(raw, &item) != nil {
+			continue
+		}
+		items = append(items, &item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].CreatedAt < items[j].CreatedAt })
+	return items, nil
+}
+
+// outboxBackoff returns the delay before the next attempt, doubling with every failed attempt.
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxMaxBackoff
+	if attempts < 20 {
+		backoff = min(outboxBaseBackoff<<(attempts-1), outboxMaxBackoff)
+	}
+	// Spread retries so a recovering server isn't hit by all of them at once.
+	return backoff + rand.N(backoff/5+1)
+}
+
+// startOutbox schedules the cluster wide job retrying queued notifications.
+func (p *Plugin) startOutbox() error {
+	job, err := cluster.Schedule(p.API, outboxJobKey, cluster.MakeWaitForInterval(outboxInterval), p.processOutbox)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule notification outbox")
+	}
+	p.outboxJob = job
+	return nil
+}
+
+// processOutbox posts all notifications which are due. Only one run per node is active at a
+// time, a request coming in meanwhile makes it run again. A cluster mutex makes sure only one node
+// processes the queue at a time, if it is taken the other node is already on it.
+func (p *Plugin) processOutbox() {
+	p.outboxRequested.Store(true)
+	if !p.outboxRunning.CompareAndSwap(false, true) {
+		return
+	}
+	defer p.outboxRunning.Store(false)
+	for p.outboxRequested.Swap(false) {
+		p.processDueNotifications()
+	}
+}
+
+func (p *Plugin) processDueNotifications() {
+	mutex, err := cluster.NewMutex(p.API, outboxLockKey)
+	if err != nil {
+		p.API.LogError("Failed to create outbox lock", "err", err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if mutex.LockWithContext(ctx) != nil {
+		return
+	}
+	defer mutex.Unlock()
+
+	items, err := p.listOutboxItems(outboxPendingPrefix)
+	if err != nil {
+		p.API.LogError("Failed to read notification outbox", "err", err.Error())
+		return
+	}
+	now := model.GetMillis()
+	for _, item := range items {
+		if item.NextAttempt <= now {
+			p.deliver(item)
+		}
+	}
+}
+
+// deliver posts a queued notification and returns the outcome. The item is removed after the
+// post was created, so a notification is posted at least once.
+func (p *Plugin) deliver(item *outboxItem) string {
+	var post *model.Post
+	botID, appErr := p.API.KVGet(botUserID)
+	if appErr == nil {
+		post, appErr = p.API.CreatePost(&model.Post{
+			ChannelId: item.ChannelID,
+			Type:      item.Type,
+			Message:   item.Message,
+			Props:     item.Props,
+			UserId:    string(botID),
+		})
+	}
+	if appErr == nil {
+		p.metrics.inc(metricNotifications, outboxDelivered)
+		if item.Vote != nil {
+			if err := p.trackVotePost(post.Id, item); err != nil {
+				p.API.LogError("Failed to track vote notification", "post_id", post.Id, "err", err.Error())
+			}
+		}
+		if err := p.deleteOutboxItem(outboxPendingPrefix, item.ID); err != nil {
+			p.API.LogError("Failed to remove posted notification from the outbox", "id", item.ID, "err", err.Error())
+		}
+		return outboxDelivered
+	}
+
+	item.Attempts++
+	item.LastError = appErr.Error()
+	// Client errors, e.g. a deleted channel, won't go away by retrying.
+	permanent := appErr.StatusCode >= http.StatusBadRequest && appErr.StatusCode < http.StatusInternalServerError
+	if permanent || item.Attempts >= outboxMaxAttempts {
+		p.metrics.inc(metricNotifications, outboxDeadLettered)
+		p.API.LogError("Giving up posting Parabol notification", "id", item.ID, "channel_id", item.ChannelID, "attempts", item.Attempts, "err", item.LastError)
+		if err := p.saveOutboxItem(outboxDeadPrefix, item); err != nil {
+			p.API.LogError("Failed to store dead letter", "id", item.ID, "err", err.Error())
+			return outboxDeadLettered
+		}
+		if err := p.deleteOutboxItem(outboxPendingPrefix, item.ID); err != nil {
+			p.API.LogError("Failed to remove dead letter from the outbox", "id", item.ID, "err", err.Error())
+		}
+		return outboxDeadLettered
+	}
+
+	p.metrics.inc(metricNotifications, "failed")
+	item.NextAttempt = model.GetMillis() + outboxBackoff(item.Attempts).Milliseconds()
+	p.API.LogWarn("Failed to post Parabol notification, retrying", "id", item.ID, "channel_id", item.ChannelID, "attempts", item.Attempts, "err", item.LastError)
+	if err := p.saveOutboxItem(outboxPendingPrefix, item); err != nil {
+		p.API.LogError("Failed to reschedule notification", "id", item.ID, "err", err.Error())
+	}
+	return outboxRetrying
+}
+
+// retryDeadLetters moves dead letters back into the queue, all of them if id is "all".
+func (p *Plugin) retryDeadLetters(id string) (int, error) {
+	items, err := p.listOutboxItems(outboxDeadPrefix)
+	if err != nil {
+		return 0, err
+	}
+	retried := 0
+	for _, item := range items {
+		if id != "all" && item.ID != id {
+			continue
+		}
+		item.Attempts = 0
+		item.NextAttempt = model.GetMillis()
+		if err := p.saveOutboxItem(outboxPendingPrefix, item); err != nil {
+			return retried, err
+		}
+		if err := p.deleteOutboxItem(outboxDeadPrefix, item.ID); err != nil {
+			return retried, err
+		}
+		retried++
+	}
+	if retried > 0 {
+		go p.processOutbox()
+	}
+	return retried, nil
+}
+
+func (p *Plugin) getOutboxState() (*outboxState, error) {
+	pending, err := p.listOutboxItems(outboxPendingPrefix)
+	if err != nil {
+		return nil, err
+	}
+	deadLetters, err := p.listOutboxItems(outboxDeadPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &outboxState{Pending: pending, DeadLetters: deadLetters}, nil
+}
+
+// getOutbox shows the queued and dead lettered notifications to system admins.
+func (p *Plugin) getOutbox(c *Context, w http.ResponseWriter, r *http.Request) {
+	state, err := p.getOutboxState()
+	if err != nil {
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Failed to read notification outbox", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// formatOutboxState renders the queue as Markdown for `/parabol admin outbox`.
+func formatOutboxState(state *outboxState) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("###### Parabol Notification Outbox\n%d pending, %d dead letters", len(state.Pending), len(state.DeadLetters)))
+	if len(state.Pending)+len(state.DeadLetters) == 0 {
+		return builder.String()
+	}
+	builder.WriteString("\n\n| ID | State | Channel | Created | Attempts | Last error |\n|---|---|---|---|---|---|")
+	for _, list := range []struct {
+		state string
+		items []*outboxItem
+	}{{"pending", state.Pending}, {"dead", state.DeadLetters}} {
+		for _, item := range list.items {
+			builder.WriteString(fmt.Sprintf("\n| `%s` | %s | `%s` | %s | %d | %s |",
+				item.ID, list.state, item.ChannelID,
+				time.UnixMilli(item.CreatedAt).UTC().Format(time.RFC3339),
+				item.Attempts, strings.ReplaceAll(item.LastError, "|", "\\|")))
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	for name, tc := range map[string]struct {
+		attempts int
+		expect   time.Duration
+	}{
+		"first retry":        {attempts: 1, expect: 5 * time.Second},
+		"doubles":            {attempts: 2, expect: 10 * time.Second},
+		"last before capped": {attempts: 10, expect: 2560 * time.Second},
+		"capped":             {attempts: 11, expect: time.Hour},
+		"capped for many":    {attempts: 100, expect: time.Hour},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// The jitter adds up to a fifth of the backoff.
+			for range 100 {
+				backoff := outboxBackoff(tc.attempts)
+				assert.GreaterOrEqual(t, backoff, tc.expect)
+				assert.LessOrEqual(t, backoff, tc.expect+tc.expect/5)
+			}
+		})
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	for name, tc := range map[string]struct {
+		attempts       int
+		postErr        *model.AppError
+		expectOutcome  string
+		expectAttempts int
+		expectPending  bool
+		expectDead     bool
+	}{
+		"posted": {
+			expectOutcome: outboxDelivered,
+		},
+		"server error is retried": {
+			postErr:        model.NewAppError("CreatePost", "app.post.save.app_error", nil, "", http.StatusInternalServerError),
+			expectOutcome:  outboxRetrying,
+			expectAttempts: 1,
+			expectPending:  true,
+		},
+		"seventh failure is retried": {
+			attempts:       6,
+			postErr:        model.NewAppError("CreatePost", "app.post.save.app_error", nil, "", http.StatusInternalServerError),
+			expectOutcome:  outboxRetrying,
+			expectAttempts: 7,
+			expectPending:  true,
+		},
+		"eighth failure is dead lettered": {
+			attempts:       7,
+			postErr:        model.NewAppError("CreatePost", "app.post.save.app_error", nil, "", http.StatusInternalServerError),
+			expectOutcome:  outboxDeadLettered,
+			expectAttempts: 8,
+			expectDead:     true,
+		},
+		"client error is dead lettered right away": {
+			postErr:        model.NewAppError("CreatePost", "app.channel.get.existing.app_error", nil, "", http.StatusNotFound),
+			expectOutcome:  outboxDeadLettered,
+			expectAttempts: 1,
+			expectDead:     true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := newTestAPI()
+			api.postErr = tc.postErr
+			p := newTestPlugin(api)
+			require.Nil(t, api.KVSet(botUserID, []byte("bot")))
+
+			item := &outboxItem{ID: model.NewId(), ChannelID: model.NewId(), Message: "hello", Attempts: tc.attempts}
+			require.NoError(t, p.saveOutboxItem(outboxPendingPrefix, item))
+
+			before := model.GetMillis()
+			assert.Equal(t, tc.expectOutcome, p.deliver(item))
+
+			pending, err := p.listOutboxItems(outboxPendingPrefix)
+			require.NoError(t, err)
+			dead, err := p.listOutboxItems(outboxDeadPrefix)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectPending, len(pending) == 1, "pending")
+			assert.Equal(t, tc.expectDead, len(dead) == 1, "dead letter")
+			for _, stored := range append(pending, dead...) {
+				assert.Equal(t, tc.expectAttempts, stored.Attempts)
+				assert.NotEmpty(t, stored.LastError)
+			}
+			if tc.expectPending {
+				assert.GreaterOrEqual(t, pending[0].NextAttempt, before+(outboxBaseBackoff<<(tc.expectAttempts-1)).Milliseconds())
+			}
+			if tc.postErr == nil {
+				require.Len(t, api.posts, 1)
+				assert.Equal(t, "bot", api.posts[0].UserId)
+			}
+		})
+	}
+}
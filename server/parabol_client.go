@@ -1,35 +1,310 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"io"
+	"net/http"
+	"os"
+	"strings"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/pkg/errors"
 	"github.com/yaronf/httpsign"
 )
 
+// Supported signature algorithms. HS256 uses the shared secret, the others use the plugin's
+// private key for outgoing and Parabol's public key for incoming requests.
+const (
+	algHS256   = "HS256"
+	algEd25519 = "ed25519"
+	algP256    = "ecdsa-p256-sha256"
+	algRSAPSS  = "rsa-pss-sha512"
+)
+
 func getJSON(body io.ReadCloser, target any) error {
 	defer func() { _ = body.Close() }()
 	return json.NewDecoder(body).Decode(target)
 }
 
-func NewSigningClient(privKey []byte) (*httpsign.Client, error) {
-	signer, err := httpsign.NewJWSSigner(jwa.SignatureAlgorithm("HS256"), privKey, httpsign.NewSignConfig().SignAlg(false),
-		httpsign.Headers("@request-target", "Content-Digest"))
+func signedFields() httpsign.Fields {
+	return httpsign.Headers("@request-target", "content-digest")
+}
+
+// NewSigner creates the signer for outgoing requests. key is the shared secret for HS256 and
+// the private key otherwise.
+func NewSigner(alg string, key any, keyID string) (*httpsign.Signer, error) {
+	config := httpsign.NewSignConfig()
+	if keyID != "" {
+		config.SetKeyID(keyID)
+	}
+
+	switch alg {
+	case "", algHS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return nil, errors.New("HS256 requires a shared secret")
+		}
+		return httpsign.NewJWSSigner(jwa.SignatureAlgorithm(algHS256), secret, config.SignAlg(false), signedFields())
+	case algEd25519:
+		privateKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("ed25519 requires an Ed25519 private key")
+		}
+		return httpsign.NewEd25519Signer(privateKey, config, signedFields())
+	case algP256:
+		privateKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok || privateKey.Curve != elliptic.P256() {
+			return nil, errors.New("ecdsa-p256-sha256 requires an ECDSA P-256 private key")
+		}
+		return httpsign.NewP256Signer(*privateKey, config, signedFields())
+	case algRSAPSS:
+		privateKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("rsa-pss-sha512 requires an RSA private key")
+		}
+		return httpsign.NewRSAPSSSigner(*privateKey, config, signedFields())
+	default:
+		return nil, errors.Errorf("unsupported signature algorithm %q", alg)
+	}
+}
+
+// NewVerifier creates the verifier for incoming requests. key is the shared secret for HS256 and
+// Parabol's public key otherwise. If keyID is set, the signature must carry the same key ID.
+func NewVerifier(alg string, key any, keyID string) (*httpsign.Verifier, error) {
+	config := httpsign.NewVerifyConfig()
+	if keyID != "" {
+		config.SetKeyID(keyID)
+	}
+
+	switch alg {
+	case "", algHS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return nil, errors.New("HS256 requires a shared secret")
+		}
+		return httpsign.NewJWSVerifier(jwa.SignatureAlgorithm(algHS256), secret, config, signedFields())
+	case algEd25519:
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("ed25519 requires an Ed25519 public key")
+		}
+		return httpsign.NewEd25519Verifier(publicKey, config, signedFields())
+	case algP256:
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || publicKey.Curve != elliptic.P256() {
+			return nil, errors.New("ecdsa-p256-sha256 requires an ECDSA P-256 public key")
+		}
+		return httpsign.NewP256Verifier(*publicKey, config, signedFields())
+	case algRSAPSS:
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("rsa-pss-sha512 requires an RSA public key")
+		}
+		return httpsign.NewRSAPSSVerifier(*publicKey, config, signedFields())
+	default:
+		return nil, errors.Errorf("unsupported signature algorithm %q", alg)
+	}
+}
+
+// NewSigningClient creates a client signing every request with signer. transport may be nil to
+// use the default transport.
+func NewSigningClient(signer *httpsign.Signer, transport http.RoundTripper) *httpsign.Client {
+	return httpsign.NewClient(http.Client{Transport: transport}, httpsign.NewClientConfig().SetSignatureName("mattermost").SetSigner(signer))
+}
+
+// readPEM returns the PEM block of a key given either inline or as a path to a file.
+func readPEM(value string) (*pem.Block, error) {
+	value = strings.TrimSpace(value)
+	raw := []byte(value)
+	if !strings.HasPrefix(value, "-----BEGIN") {
+		var err error
+		if raw, err = os.ReadFile(value); err != nil { //nolint:gosec
+			return nil, errors.Wrap(err, "failed to read key file")
+		}
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("key is not PEM encoded")
+	}
+	return block, nil
+}
+
+// loadPrivateKey parses a PKCS #8, SEC 1 or PKCS #1 private key.
+func loadPrivateKey(value string) (any, error) {
+	block, err := readPEM(value)
 	if err != nil {
 		return nil, err
 	}
-
-	client := httpsign.NewDefaultClient(httpsign.NewClientConfig().SetSignatureName("mattermost").SetSigner(signer))
-	return client, nil
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key format")
 }
 
-func NewVerifier(privKey []byte) (*httpsign.Verifier, error) {
-	verifier, err := httpsign.NewJWSVerifier(jwa.SignatureAlgorithm("HS256"), privKey, httpsign.NewVerifyConfig(),
-		httpsign.Headers("@request-target", "content-digest"))
+// loadPublicKey parses a PKIX or PKCS #1 public key.
+func loadPublicKey(value string) (any, error) {
+	block, err := readPEM(value)
 	if err != nil {
 		return nil, err
 	}
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported public key format")
+}
+
+// prepare loads the keys of the connection and creates its signer and verifiers.
+func (c *parabolConnection) prepare() error {
+	if c.isSharedSecret() {
+		signer, err := NewSigner(algHS256, []byte(c.Token), c.KeyID)
+		if err != nil {
+			return errors.Wrap(err, "failed to create signer")
+		}
+		verifiers := make([]*httpsign.Verifier, 0, 2)
+		for _, token := range []string{c.Token, c.SecondaryToken} {
+			if token == "" {
+				continue
+			}
+			verifier, err := NewVerifier(algHS256, []byte(token), c.ParabolKeyID)
+			if err != nil {
+				return errors.Wrap(err, "failed to create verifier")
+			}
+			verifiers = append(verifiers, verifier)
+		}
+		c.signer, c.verifiers = signer, verifiers
+		return nil
+	}
+
+	privateKey, err := loadPrivateKey(c.PrivateKey)
+	if err != nil {
+		return errors.Wrap(err, "private key")
+	}
+	signer, err := NewSigner(c.Algorithm, privateKey, c.KeyID)
+	if err != nil {
+		return err
+	}
+	publicKey, err := loadPublicKey(c.ParabolPublicKey)
+	if err != nil {
+		return errors.Wrap(err, "Parabol public key")
+	}
+	verifier, err := NewVerifier(c.Algorithm, publicKey, c.ParabolKeyID)
+	if err != nil {
+		return err
+	}
+	c.signer, c.verifiers = signer, []*httpsign.Verifier{verifier}
+	return nil
+}
+
+// signingClient returns a client signing requests to Parabol on behalf of the connection.
+func (c *parabolConnection) signingClient(transport http.RoundTripper) (*httpsign.Client, error) {
+	if c.signer == nil {
+		if err := c.prepare(); err != nil {
+			return nil, err
+		}
+	}
+	return NewSigningClient(c.signer, transport), nil
+}
 
-	return verifier, nil
+// signingClient returns an instrumented client signing requests to Parabol on behalf of the
+// connection.
+func (p *Plugin) signingClient(connection *parabolConnection) (*httpsign.Client, error) {
+	return connection.signingClient(p.metrics.transport(connection.Name))
+}
+
+// callParabol sends body as signed JSON request to the path of the connection and decodes the
+// response into result, which may be nil.
+func (p *Plugin) callParabol(ctx context.Context, connection *parabolConnection, path string, body, result any) error {
+	client, err := p.signingClient(connection)
+	if err != nil {
+		return errors.Wrap(err, "failed to create signing client")
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize request")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, connection.URL+path, bytes.NewReader(raw))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to reach Parabol")
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		return errors.Errorf("Parabol responded with status %d", res.StatusCode)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxUpstreamBodyLength)).Decode(result); err != nil {
+		return errors.Wrap(err, "invalid response from Parabol")
+	}
+	return nil
+}
+
+// verifyRequest checks the signature of a request from Parabol against the primary key of the
+// connection and, while a rotation is in progress, against the secondary token.
+func verifyRequest(connection *parabolConnection, r *http.Request) (usedSecondary bool, err error) {
+	if connection.verifiers == nil {
+		if err = connection.prepare(); err != nil {
+			return false, err
+		}
+	}
+	for i, verifier := range connection.verifiers {
+		verifyErr := httpsign.VerifyRequest("parabol", *verifier, r)
+		if verifyErr == nil {
+			return i > 0, validateContentDigest(r)
+		}
+		if i == 0 {
+			err = verifyErr
+		}
+	}
+	return false, err
+}
+
+// validateContentDigest checks the signed Content-Digest header against the body, which is read
+// up to maxBatchBodyLength and made available to the handler again. A longer body doesn't match.
+func validateContentDigest(r *http.Request) error {
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+	body := io.NopCloser(io.LimitReader(r.Body, maxBatchBodyLength+1))
+	if err := httpsign.ValidateContentDigestHeader(r.Header.Values("Content-Digest"), &body, []string{httpsign.DigestSha256, httpsign.DigestSha512}); err != nil {
+		return errors.Wrap(err, "invalid content digest")
+	}
+	r.Body = body
+	return nil
+}
+
+// verifyAnyConnection checks the signature of a request which isn't bound to a team against all
+// connections and returns the one which signed it.
+func (p *Plugin) verifyAnyConnection(r *http.Request) (*parabolConnection, bool, error) {
+	err := errNoConnection
+	for _, connection := range p.getConfiguration().connections {
+		usedSecondary, verifyErr := verifyRequest(connection, r)
+		if verifyErr == nil {
+			return connection, usedSecondary, nil
+		}
+		err = verifyErr
+	}
+	return nil, false, err
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yaronf/httpsign"
+)
+
+const testToken = "0f4c8a1e9b7d2c6f3a5e8d1b4c7f0a2e9d6b3c8f1e4a7d0c5b2f9e6a3d8c1b4f"
+
+func generateKeyPair(t *testing.T, alg string) (crypto.PrivateKey, crypto.PublicKey) {
+	t.Helper()
+	switch alg {
+	case algEd25519:
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return privateKey, publicKey
+	case algP256:
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return privateKey, &privateKey.PublicKey
+	case algRSAPSS:
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return privateKey, &privateKey.PublicKey
+	}
+	t.Fatalf("unknown algorithm %s", alg)
+	return nil, nil
+}
+
+func privateKeyPEM(t *testing.T, key crypto.PrivateKey) string {
+	t.Helper()
+	raw, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: raw}))
+}
+
+func publicKeyPEM(t *testing.T, key crypto.PublicKey) string {
+	t.Helper()
+	raw, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: raw}))
+}
+
+// signAsParabol signs a notification the way Parabol does, standing in for the Parabol server.
+func signAsParabol(t *testing.T, signer *httpsign.Signer) *http.Request {
+	t.Helper()
+	return signRequestAsParabol(t, signer, http.MethodPost, "http://mattermost.test/plugins/co.parabol.action/notify/channel", []byte(`{"message":"hello"}`))
+}
+
+// signRequestAsParabol signs a request with the method and body to the URL the way Parabol does.
+func signRequestAsParabol(t *testing.T, signer *httpsign.Signer, method, url string, body []byte) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(method, url, bytes.NewReader(body))
+	digestBody := io.NopCloser(bytes.NewReader(body))
+	digest, err := httpsign.GenerateContentDigestHeader(&digestBody, []string{httpsign.DigestSha256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Digest", digest)
+	signatureInput, signature, err := httpsign.SignRequest("parabol", *signer, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Signature-Input", signatureInput)
+	req.Header.Set("Signature", signature)
+	return req
+}
+
+func TestVerifyRequest(t *testing.T) {
+	for _, alg := range []string{algEd25519, algP256, algRSAPSS} {
+		t.Run(alg, func(t *testing.T) {
+			pluginPrivate, _ := generateKeyPair(t, alg)
+			parabolPrivate, parabolPublic := generateKeyPair(t, alg)
+			otherPrivate, _ := generateKeyPair(t, alg)
+
+			connection := &parabolConnection{
+				Name:             "test",
+				URL:              "https://parabol.test",
+				Algorithm:        alg,
+				PrivateKey:       privateKeyPEM(t, pluginPrivate),
+				ParabolPublicKey: publicKeyPEM(t, parabolPublic),
+				ParabolKeyID:     "parabol-1",
+			}
+			if err := connection.IsValid(false); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			parabolSigner, err := NewSigner(alg, parabolPrivate, "parabol-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := verifyRequest(connection, signAsParabol(t, parabolSigner)); err != nil {
+				t.Errorf("expected signature from Parabol to verify: %v", err)
+			}
+
+			wrongKeyID, err := NewSigner(alg, parabolPrivate, "parabol-2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := verifyRequest(connection, signAsParabol(t, wrongKeyID)); err == nil {
+				t.Error("expected signature with unknown key ID to be rejected")
+			}
+
+			otherSigner, err := NewSigner(alg, otherPrivate, "parabol-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := verifyRequest(connection, signAsParabol(t, otherSigner)); err == nil {
+				t.Error("expected signature from another key to be rejected")
+			}
+
+			tampered := signAsParabol(t, parabolSigner)
+			tampered.Body = io.NopCloser(strings.NewReader(`{"message":"changed"}`))
+			if _, err := verifyRequest(connection, tampered); err == nil {
+				t.Error("expected body not matching the content digest to be rejected")
+			}
+		})
+	}
+}
+
+func TestSigningClient(t *testing.T) {
+	for _, alg := range []string{algEd25519, algP256, algRSAPSS} {
+		t.Run(alg, func(t *testing.T) {
+			pluginPrivate, pluginPublic := generateKeyPair(t, alg)
+			_, parabolPublic := generateKeyPair(t, alg)
+
+			parabolVerifier, err := NewVerifier(alg, pluginPublic, "mattermost-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var verifyErr error
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				verifyErr = httpsign.VerifyRequest("mattermost", *parabolVerifier, r)
+			}))
+			defer server.Close()
+
+			connection := &parabolConnection{
+				Name:             "test",
+				URL:              server.URL,
+				Algorithm:        alg,
+				PrivateKey:       privateKeyPEM(t, pluginPrivate),
+				ParabolPublicKey: publicKeyPEM(t, parabolPublic),
+				KeyID:            "mattermost-1",
+			}
+			client, err := connection.signingClient(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := client.Post(server.URL+"/mattermost", "application/json", bytes.NewReader([]byte(`{}`)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = res.Body.Close()
+			if verifyErr != nil {
+				t.Errorf("expected Parabol to verify the plugin signature: %v", verifyErr)
+			}
+		})
+	}
+}
+
+func TestVerifyRequestSharedSecret(t *testing.T) {
+	const previousToken = "7e2a9c4f1b8d3e6a0c5f2b9d4e7a1c8f3b6d0e5a2c9f4b7e1d8a3c6f0b5e2d9a"
+
+	for name, tc := range map[string]struct {
+		signingToken  string
+		expectValid   bool
+		expectPrimary bool
+	}{
+		"primary token": {
+			signingToken:  testToken,
+			expectValid:   true,
+			expectPrimary: true,
+		},
+		"secondary token": {
+			signingToken: previousToken,
+			expectValid:  true,
+		},
+		"unknown token": {
+			signingToken: "3c8f1e4a7d0c5b2f9e6a3d8c1b4f0f4c8a1e9b7d2c6f3a5e8d1b4c7f0a2e9d6b",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			connection := &parabolConnection{
+				Name:           "test",
+				URL:            "https://parabol.test",
+				Token:          testToken,
+				SecondaryToken: previousToken,
+			}
+			if err := connection.IsValid(false); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			signer, err := NewSigner(algHS256, []byte(tc.signingToken), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			usedSecondary, err := verifyRequest(connection, signAsParabol(t, signer))
+			if tc.expectValid != (err == nil) {
+				t.Fatalf("expected valid %v, got error %v", tc.expectValid, err)
+			}
+			if tc.expectValid && usedSecondary == tc.expectPrimary {
+				t.Errorf("expected primary %v, got secondary %v", tc.expectPrimary, usedSecondary)
+			}
+		})
+	}
+}
@@ -6,18 +6,18 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin"
-
-	"github.com/yaronf/httpsign"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
 )
 
 const (
@@ -25,6 +25,8 @@ const (
 	requestTimeout = 30 * time.Second
 	// well below the 4kb limit of nginx
 	maxHeaderLength = 1024
+	// limit for upstream responses which are buffered instead of streamed
+	maxUpstreamBodyLength = 1 << 20
 )
 
 type SlashCommand struct {
@@ -51,6 +53,37 @@ type Plugin struct {
 
 	// router is the HTTP router for handling API requests.
 	router *mux.Router
+
+	// metrics collects the plugin's metrics, see serveMetrics.
+	metrics *metrics
+
+	// rateLimiter keeps the local token buckets of the rate limited routes.
+	rateLimiter *rateLimiter
+
+	// mentionCache keeps the Mattermost users Parabol users resolved to, see mentionsFor.
+	mentionCache *mentionCache
+
+	// outboxJob retries notifications which couldn't be posted yet.
+	outboxJob *cluster.Job
+
+	// outboxRunning and outboxRequested keep processOutbox to a single run per node.
+	outboxRunning   atomic.Bool
+	outboxRequested atomic.Bool
+
+	// standupJob posts the scheduled standup reminders.
+	standupJob *cluster.Job
+
+	// meetingScheduleJob starts the meetings scheduled with /parabol schedule.
+	meetingScheduleJob *cluster.Job
+
+	// membershipSyncJob reconciles the members of synced channels with their Parabol teams.
+	membershipSyncJob *cluster.Job
+
+	// userSweepJob removes linked users who were deactivated or deleted.
+	userSweepJob *cluster.Job
+
+	// channelLinkJob pauses and resumes the links of archived and restored channels.
+	channelLinkJob *cluster.Job
 }
 
 type Context struct {
@@ -94,8 +127,7 @@ func (p *Plugin) authenticated(handler HTTPHandlerFuncWithContext) http.HandlerF
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := r.Header.Get("Mattermost-User-ID")
 		if userID == "" {
-			w.WriteHeader(http.StatusUnauthorized)
-			_, _ = w.Write([]byte(`{"error": "Not authorized"}`))
+			p.writeError(w, r, http.StatusUnauthorized, errCodeUnauthorized, "Not authorized", nil)
 			return
 		}
 
@@ -105,6 +137,17 @@ func (p *Plugin) authenticated(handler HTTPHandlerFuncWithContext) http.HandlerF
 	}
 }
 
+// adminOnly restricts a handler to system admins.
+func (p *Plugin) adminOnly(handler HTTPHandlerFuncWithContext) HTTPHandlerFuncWithContext {
+	return func(c *Context, w http.ResponseWriter, r *http.Request) {
+		if !p.API.HasPermissionTo(c.UserID, model.PermissionManageSystem) {
+			p.writeError(w, r, http.StatusForbidden, errCodeForbidden, "Only system admins can access this route", nil)
+			return
+		}
+		handler(c, w, r)
+	}
+}
+
 /*
 Mattermost strips the plugin path prefix from the request before forwarding it to the plugin.
 If we want to verify the path of the request, we need to add it back.
@@ -119,64 +162,97 @@ func (p *Plugin) fixedPath(handler http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func (p *Plugin) notify(w http.ResponseWriter, r *http.Request) {
-	config := p.getConfiguration()
-	privKey := []byte(config.ParabolToken)
-	verifier, err := NewVerifier(privKey)
+// verifyAnyNotification verifies the signature of a request from Parabol which isn't bound to a
+// single connection, see verifyAnyConnection. A failure is audited and answered, in which case nil
+// is returned.
+func (p *Plugin) verifyAnyNotification(w http.ResponseWriter, r *http.Request, target string) *parabolConnection {
+	connection, usedSecondary, err := p.verifyAnyConnection(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(`{"error": "Verify config error"}`))
-		return
+		p.metrics.inc(metricSignatureFailures, "unknown")
+		p.metrics.inc(metricNotifications, "rejected")
+		p.audit(r, auditRecord{
+			Action:  auditActionNotifySignature,
+			Target:  target,
+			Outcome: auditOutcomeFailure,
+		})
+		p.writeError(w, r, http.StatusUnauthorized, errCodeInvalidSignature, "Verification error", err)
+		return nil
 	}
-	if err1 := httpsign.VerifyRequest("parabol", *verifier, r); err1 != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(`{"error": "Verification error"}`))
-		return
+	if usedSecondary {
+		p.API.LogWarn("Parabol notification was signed with the secondary token, update the secret in Parabol and finish the rotation", "connection", connection.Name)
 	}
+	return connection
+}
 
+// verifyChannelNotification verifies the signature of a request from Parabol for a channel. The
+// signature is checked before the channel is looked at, so unsigned requests can't tell channels
+// with and without a connection apart. The channel must be served by the connection whose key
+// signed the request. A failure is answered, in which case nil is returned.
+func (p *Plugin) verifyChannelNotification(w http.ResponseWriter, r *http.Request, channelID string) *parabolConnection {
+	connection := p.verifyAnyNotification(w, r, channelID)
+	if connection == nil {
+		return nil
+	}
+	served, err := p.connectionForChannel(channelID)
+	if err != nil || served != connection {
+		p.writeError(w, r, http.StatusNotFound, errCodeNoConnection, "Channel is not served by the signing connection", err)
+		return nil
+	}
+	return connection
+}
+
+func (p *Plugin) notify(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	channelID := vars["channelID"]
-	userID, err1 := p.API.KVGet(botUserID)
-	if err1 != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		msg := fmt.Sprintf(`{"error": "Bot User not found", "originalError": "%v"}`, err1)
-		_, _ = w.Write([]byte(msg))
+	connection := p.verifyChannelNotification(w, r, channelID)
+	if connection == nil {
+		return
+	}
+	if p.channelArchived(channelID) {
+		p.writeError(w, r, http.StatusGone, errCodeChannelArchived, "Channel is archived", nil)
 		return
 	}
 
-	var props map[string]any
-	if err := getJSON(r.Body, &props); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		msg := fmt.Sprintf(`{"error": "Error parsing body", "originalError": "%v"}`, err)
-		_, _ = w.Write([]byte(msg))
+	n, err := parseNotification(r.Body)
+	if err != nil {
+		p.writeNotificationError(w, r, err)
 		return
 	}
-	if _, err := p.API.CreatePost(&model.Post{
-		ChannelId: channelID,
-		Props:     props,
-		UserId:    string(userID),
-	}); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		msg := fmt.Sprintf(`{"error": "Error posting notification", "originalError": "%v"}`, err)
-		_, _ = w.Write([]byte(msg))
+
+	// The notification is posted asynchronously, so it isn't lost if posting fails.
+	item := p.newOutboxItem(channelID, connection, n)
+	if err := p.enqueueNotification(item); err != nil {
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error queueing notification", err)
 		return
 	}
+	p.metrics.inc(metricNotifications, "queued")
+	writeJSON(w, http.StatusAccepted, struct {
+		ID string `json:"id"`
+	}{
+		ID: item.ID,
+	})
 }
 
 func (p *Plugin) login(c *Context, w http.ResponseWriter, r *http.Request) {
 	var variables json.RawMessage
 	if err := getJSON(r.Body, &variables); err != nil && err != io.EOF {
-		w.WriteHeader(http.StatusBadRequest)
+		p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Error parsing body", err)
+		return
+	}
+	if c.User == nil {
+		p.writeError(w, r, http.StatusUnauthorized, errCodeUnauthorized, "User not found", nil)
 		return
 	}
 
-	config := p.getConfiguration()
-	url := config.ParabolURL + "/mattermost"
-	privKey := []byte(config.ParabolToken)
-	client, err := NewSigningClient(privKey)
+	connection, err := p.connectionForRequest(r, c.UserID)
+	if err != nil {
+		p.writeError(w, r, http.StatusForbidden, errCodeNoConnection, "No Parabol connection for team", err)
+		return
+	}
+	url := connection.URL + "/mattermost"
+	client, err := p.signingClient(connection)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(`{"error": "Signing error"}`))
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Signing error", err)
 		return
 	}
 
@@ -187,103 +263,119 @@ func (p *Plugin) login(c *Context, w http.ResponseWriter, r *http.Request) {
 	}
 	requestBody, err := json.Marshal(query)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(`{"error": "Marshal error"}`))
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Marshal error", err)
 		return
 	}
-	res, err := client.Post(url, "application/json", bufio.NewReader(bytes.NewReader(requestBody)))
-	w.Header().Set("Content-Type", "application/json")
+	req, err := http.NewRequestWithContext(c.Ctx, http.MethodPost, url, bufio.NewReader(bytes.NewReader(requestBody)))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		msg := fmt.Sprintf(`{"error": "Parabol server error", "originalError": "%v", "statusCode": "%v"}`, err, res.StatusCode)
-		_, _ = w.Write([]byte(msg))
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Request error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	loginAudit := auditRecord{
+		ActorID: c.UserID,
+		Action:  auditActionLogin,
+		Target:  connection.Name,
+		Outcome: auditOutcomeFailure,
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		p.audit(r, loginAudit)
+		p.writeUpstreamError(w, r, err)
 		return
 	}
 	defer func() { _ = res.Body.Close() }()
-	responseBody, err := io.ReadAll(res.Body)
+	responseBody, err := io.ReadAll(io.LimitReader(res.Body, maxUpstreamBodyLength))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(`{"error": "Serialization error"}`))
+		p.audit(r, loginAudit)
+		p.writeUpstreamError(w, r, err)
 		return
 	}
 
+	loginAudit.Details = map[string]string{"status": strconv.Itoa(res.StatusCode)}
 	if res.StatusCode != http.StatusOK {
-		w.WriteHeader(res.StatusCode)
-		msg := fmt.Sprintf(`{"error": "%s"}`, responseBody)
-		_, _ = w.Write([]byte(msg))
+		p.audit(r, loginAudit)
+		p.writeUpstreamStatus(w, r, res.StatusCode, responseBody)
 		return
 	}
+	loginAudit.Outcome = auditOutcomeSuccess
+	p.audit(r, loginAudit)
 
-	if _, err = w.Write(responseBody); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(`{"error": "Response error"}`))
-		return
+	// Link the accounts so notifications for the Parabol user reach the Mattermost user.
+	var loggedIn struct {
+		UserID string `json:"userId"`
+	}
+	if json.Unmarshal(responseBody, &loggedIn) == nil && loggedIn.UserID != "" {
+		if err := p.storeIdentity(connection, loggedIn.UserID, c.UserID); err != nil {
+			p.API.LogWarn("Failed to link Parabol user", "user_id", c.UserID, "err", err.Error())
+		}
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(responseBody)
 }
 
 func (p *Plugin) graphql(w http.ResponseWriter, r *http.Request) {
-	config := p.getConfiguration()
-	url := config.ParabolURL + "/graphql"
-	privKey := []byte(config.ParabolToken)
+	connection, err := p.connectionForRequest(r, r.Header.Get("Mattermost-User-ID"))
+	if err != nil {
+		p.writeError(w, r, http.StatusForbidden, errCodeNoConnection, "No Parabol connection for team", err)
+		return
+	}
+	url := connection.URL + "/graphql"
 
-	client, err := NewSigningClient(privKey)
+	client, err := p.signingClient(connection)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(`{"error": "Signing error"}`))
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Signing error", err)
 		return
 	}
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
 	defer func() { _ = r.Body.Close() }()
-	req, err1 := http.NewRequest("POST", url, r.Body)
-	if err1 != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		msg := fmt.Sprintf(`{"error": "Request error", "originalError": "%v"}`, err1)
-		_, _ = w.Write([]byte(msg))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, r.Body)
+	if err != nil {
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Request error", err)
 		return
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
-	if errCopy := safeCopyHeader(r.Header, "x-application-authorization", req.Header); errCopy != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		msg := fmt.Sprintf(`{"error": "Header error", "originalError": "%v"}`, errCopy)
-		_, _ = w.Write([]byte(msg))
+	if err := safeCopyHeader(r.Header, "x-application-authorization", req.Header); err != nil {
+		p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Header error", err)
 		return
 	}
 
-	if errCopy := safeCopyHeader(r.Header, "authorization", req.Header); errCopy != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		msg := fmt.Sprintf(`{"error": "Header error", "originalError": "%v"}`, errCopy)
-		_, _ = w.Write([]byte(msg))
+	if err := safeCopyHeader(r.Header, "authorization", req.Header); err != nil {
+		p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Header error", err)
 		return
 	}
 
-	res, err2 := client.Do(req)
-	if err2 != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		msg := fmt.Sprintf(`{"error": "Request error", "originalError": "%v"}`, err2)
-		_, _ = w.Write([]byte(msg))
+	res, err := client.Do(req)
+	if err != nil {
+		p.writeUpstreamError(w, r, err)
 		return
 	}
 	defer func() { _ = res.Body.Close() }()
 
+	if contentType := res.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
 	w.WriteHeader(res.StatusCode)
 	_, _ = io.Copy(w, res.Body)
 }
 
 func (p *Plugin) getConfig(c *Context, w http.ResponseWriter, r *http.Request) {
-	config := p.getConfiguration()
-	body, err := json.Marshal(struct {
-		ParabolURL string `json:"parabolUrl"`
-	}{
-		ParabolURL: config.ParabolURL,
-	})
+	connection, err := p.connectionForRequest(r, c.UserID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(`{"error": "Marshal error"}`))
+		p.writeError(w, r, http.StatusForbidden, errCodeNoConnection, "No Parabol connection for team", err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	_, _ = w.Write(body)
+	writeJSON(w, http.StatusOK, struct {
+		ParabolURL     string `json:"parabolUrl"`
+		ConnectionName string `json:"connectionName"`
+	}{
+		ParabolURL:     connection.URL,
+		ConnectionName: connection.Name,
+	})
 }
 
 /*
@@ -293,24 +385,30 @@ We cannot contact the Parabol instance directly from the webapp because of secur
 func (p *Plugin) components(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	file := vars["file"]
-	config := p.getConfiguration()
-	url := config.ParabolURL + "/components/" + file
+	connection, err := p.connectionForRequest(r, r.Header.Get("Mattermost-User-ID"))
+	if err != nil {
+		p.writeError(w, r, http.StatusForbidden, errCodeNoConnection, "No Parabol connection for team", err)
+		return
+	}
+	url := connection.URL + "/components/" + file
 
-	client := &http.Client{}
-	res, err := client.Get(url)
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		http.Error(w, "Server Error", http.StatusBadGateway)
-		msg := fmt.Sprintf(`{"error": "Request error", "originalError": "%v"}`, err)
-		_, _ = w.Write([]byte(msg))
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Request error", err)
+		return
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		p.writeUpstreamError(w, r, err)
 		return
 	}
 	defer func() { _ = res.Body.Close() }()
 
 	for header := range res.Header {
 		if err := safeCopyHeader(res.Header, header, w.Header()); err != nil {
-			http.Error(w, "Server Error", http.StatusInternalServerError)
-			msg := fmt.Sprintf(`{"error": "Header error", "originalError": "%v"}`, err)
-			_, _ = w.Write([]byte(msg))
+			p.writeError(w, r, http.StatusBadGateway, errCodeUpstream, "Header error", err)
 			return
 		}
 	}
@@ -322,8 +420,12 @@ func (p *Plugin) components(w http.ResponseWriter, r *http.Request) {
 func (p *Plugin) parabolRedirect(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	path := vars["path"]
-	config := p.getConfiguration()
-	url := config.ParabolURL + "/" + path
+	connection, err := p.connectionForRequest(r, r.Header.Get("Mattermost-User-ID"))
+	if err != nil {
+		p.writeError(w, r, http.StatusForbidden, errCodeNoConnection, "No Parabol connection for team", err)
+		return
+	}
+	url := connection.URL + "/" + path
 	http.Redirect(w, r, url, http.StatusSeeOther)
 }
 
@@ -342,19 +444,29 @@ func commandsEqual(a, b []SlashCommand) bool {
 func (p *Plugin) connect(c *Context, w http.ResponseWriter, r *http.Request) {
 	var config ClientConfig
 	if err := getJSON(r.Body, &config); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		msg := fmt.Sprintf(`{"error": "Error parsing commands", "originalError": "%v"}`, err)
-		_, _ = w.Write([]byte(msg))
+		p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Error parsing commands", err)
 		return
 	}
 	if !commandsEqual(p.commands, config.Commands) {
+		triggers := make([]string, 0, len(config.Commands))
+		for _, command := range config.Commands {
+			triggers = append(triggers, command.Trigger)
+		}
+		connectAudit := auditRecord{
+			ActorID: c.UserID,
+			Action:  auditActionConnect,
+			Target:  strings.Join(triggers, ","),
+			Outcome: auditOutcomeSuccess,
+		}
+
 		p.commands = config.Commands
 		if err := p.registerCommands(); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			msg := fmt.Sprintf(`{"error": "Error registering commands", "originalError": "%v"}`, err)
-			_, _ = w.Write([]byte(msg))
+			connectAudit.Outcome = auditOutcomeFailure
+			p.audit(r, connectAudit)
+			p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error registering commands", err)
 			return
 		}
+		p.audit(r, connectAudit)
 	}
 	w.WriteHeader(http.StatusOK)
 }
@@ -362,14 +474,29 @@ func (p *Plugin) connect(c *Context, w http.ResponseWriter, r *http.Request) {
 // initRouter initializes the HTTP router for the plugin.
 func (p *Plugin) initRouter() *mux.Router {
 	router := mux.NewRouter()
-
-	router.HandleFunc("/notify/{channelID}", p.fixedPath(p.notify)).Methods("POST")
-	router.HandleFunc("/login", p.authenticated(p.login)).Methods("POST")
-	router.HandleFunc("/graphql", p.graphql).Methods("POST")
+	router.Use(p.withRequestID)
+	router.Use(p.withMetrics)
+	router.NotFoundHandler = p.withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.writeError(w, r, http.StatusNotFound, errCodeNotFound, "Not found", nil)
+	}))
+
+	router.HandleFunc("/notify/user", p.rateLimited(rateLimitRouteNotify, p.fixedPath(p.notifyUser))).Methods("POST")
+	router.HandleFunc("/notify", p.rateLimited(rateLimitRouteNotify, p.fixedPath(p.notifyBatch))).Methods("POST")
+	router.HandleFunc("/notify/{channelID}", p.rateLimited(rateLimitRouteNotify, p.fixedPath(p.notify))).Methods("POST")
+	router.HandleFunc("/notify/{channelID}/summary", p.rateLimited(rateLimitRouteNotify, p.fixedPath(p.notifySummary))).Methods("POST")
+	router.HandleFunc("/links/{channelID}", p.rateLimited(rateLimitRouteNotify, p.fixedPath(p.linkChannel))).Methods("PUT", "DELETE")
+	router.HandleFunc("/login", p.rateLimited(rateLimitRouteLogin, p.authenticated(p.login))).Methods("POST")
+	router.HandleFunc("/graphql", p.rateLimited(rateLimitRouteGraphQL, p.graphql)).Methods("POST")
+	router.HandleFunc("/actions", p.authenticated(p.handleAction)).Methods("POST")
+	router.HandleFunc("/reflect", p.authenticated(p.reflectPost)).Methods("POST")
 	router.HandleFunc("/connect", p.authenticated(p.connect)).Methods("POST")
 	router.HandleFunc("/config", p.authenticated(p.getConfig)).Methods("GET")
-	router.HandleFunc("/components/{file}", p.components).Methods("GET")
+	router.HandleFunc("/components/{file}", p.rateLimited(rateLimitRouteComponents, p.components)).Methods("GET")
 	router.HandleFunc("/parabol/{path...}", p.parabolRedirect).Methods("GET")
+	router.HandleFunc("/metrics", p.authenticated(p.adminOnly(p.serveMetrics))).Methods("GET")
+	router.HandleFunc("/admin/audit", p.authenticated(p.adminOnly(p.getAuditLog))).Methods("GET")
+	router.HandleFunc("/admin/outbox", p.authenticated(p.adminOnly(p.getOutbox))).Methods("GET")
+	router.HandleFunc("/admin/rotate", p.authenticated(p.adminOnly(p.submitRotation))).Methods("POST")
 
 	return router
 }
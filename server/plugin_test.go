@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+// testAPI is an in-memory stand-in for the parts of the plugin API the tests use. Calling any
+// other method panics.
+type testAPI struct {
+	plugin.API
+
+	lock      sync.Mutex
+	kv        map[string][]byte
+	clustered bool
+	channels  map[string]*model.Channel
+	// teams are the team IDs of each user.
+	teams map[string][]string
+
+	// posts are the created posts, postErr fails creating them.
+	posts   []*model.Post
+	postErr *model.AppError
+}
+
+func newTestAPI() *testAPI {
+	return &testAPI{kv: make(map[string][]byte), channels: make(map[string]*model.Channel), teams: make(map[string][]string)}
+}
+
+func newTestPlugin(api *testAPI) *Plugin {
+	p := &Plugin{
+		metrics:      newMetrics(),
+		rateLimiter:  newRateLimiter(),
+		mentionCache: newMentionCache(),
+	}
+	p.SetAPI(api)
+	return p
+}
+
+func (a *testAPI) GetConfig() *model.Config {
+	config := &model.Config{}
+	config.SetDefaults()
+	config.ClusterSettings.Enable = model.NewPointer(a.clustered)
+	return config
+}
+
+func (a *testAPI) KVGet(key string) ([]byte, *model.AppError) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return bytes.Clone(a.kv[key]), nil
+}
+
+func (a *testAPI) KVSet(key string, value []byte) *model.AppError {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.kv[key] = bytes.Clone(value)
+	return nil
+}
+
+func (a *testAPI) KVSetWithOptions(key string, value []byte, options model.PluginKVSetOptions) (bool, *model.AppError) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	current, exists := a.kv[key]
+	if options.Atomic && (exists != (options.OldValue != nil) || !bytes.Equal(current, options.OldValue)) {
+		return false, nil
+	}
+	if value == nil {
+		delete(a.kv, key)
+	} else {
+		a.kv[key] = bytes.Clone(value)
+	}
+	return true, nil
+}
+
+func (a *testAPI) KVDelete(key string) *model.AppError {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.kv, key)
+	return nil
+}
+
+func (a *testAPI) KVList(page, perPage int) ([]string, *model.AppError) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	keys := make([]string, 0, len(a.kv))
+	for key := range a.kv {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	start := min(page*perPage, len(keys))
+	return keys[start:min(start+perPage, len(keys))], nil
+}
+
+func (a *testAPI) GetChannel(channelID string) (*model.Channel, *model.AppError) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	channel, ok := a.channels[channelID]
+	if !ok {
+		return nil, model.NewAppError("GetChannel", "app.channel.get.existing.app_error", nil, "", http.StatusNotFound)
+	}
+	clone := *channel
+	return &clone, nil
+}
+
+func (a *testAPI) GetTeamsForUser(userID string) ([]*model.Team, *model.AppError) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	teams := make([]*model.Team, 0, len(a.teams[userID]))
+	for _, teamID := range a.teams[userID] {
+		teams = append(teams, &model.Team{Id: teamID})
+	}
+	return teams, nil
+}
+
+func (a *testAPI) PublishPluginClusterEvent(model.PluginClusterEvent, model.PluginClusterEventSendOptions) error {
+	return nil
+}
+
+func (a *testAPI) CreatePost(post *model.Post) (*model.Post, *model.AppError) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.postErr != nil {
+		return nil, a.postErr
+	}
+	post.Id = model.NewId()
+	a.posts = append(a.posts, post)
+	return post, nil
+}
+
+func (a *testAPI) LogDebug(string, ...any) {}
+func (a *testAPI) LogInfo(string, ...any)  {}
+func (a *testAPI) LogWarn(string, ...any)  {}
+func (a *testAPI) LogError(string, ...any) {}
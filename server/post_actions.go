@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// Keys of the context Mattermost passes back when a button is clicked. The context is stored
+// server side with the post, so it can be trusted.
+const (
+	actionContextID         = "action"
+	actionContextValue      = "value"
+	actionContextConnection = "connection"
+)
+
+// actionRequest is sent to Parabol when a user clicks a button of a notification.
+type actionRequest struct {
+	Action    string `json:"action"`
+	Value     string `json:"value,omitempty"`
+	Email     string `json:"email"`
+	UserID    string `json:"userId,omitempty"`
+	PostID    string `json:"postId"`
+	ChannelID string `json:"channelId"`
+	TeamID    string `json:"teamId,omitempty"`
+}
+
+// actionResponse is Parabol's answer to a click. Message is shown to the clicking user only,
+// Update replaces the notification.
+type actionResponse struct {
+	Message string          `json:"message,omitempty"`
+	Update  json.RawMessage `json:"update,omitempty"`
+}
+
+func actionEphemeral(w http.ResponseWriter, text string) {
+	writeJSON(w, http.StatusOK, &model.PostActionIntegrationResponse{EphemeralText: text})
+}
+
+// handleAction is the integration URL of the notification buttons. It calls Parabol on behalf of
+// the clicking user and updates the notification with the result.
+func (p *Plugin) handleAction(c *Context, w http.ResponseWriter, r *http.Request) {
+	var request model.PostActionIntegrationRequest
+	if err := getJSON(r.Body, &request); err != nil {
+		p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Error parsing body", err)
+		return
+	}
+	// The request is forwarded by Mattermost, which sets the user header for the clicking user.
+	if request.UserId != c.UserID || c.User == nil {
+		p.writeError(w, r, http.StatusForbidden, errCodeForbidden, "Action was not triggered by this user", nil)
+		return
+	}
+
+	post, appErr := p.API.GetPost(request.PostId)
+	if appErr != nil {
+		p.writeError(w, r, http.StatusNotFound, errCodeNotFound, "Post not found", appErr)
+		return
+	}
+	botID, appErr := p.API.KVGet(botUserID)
+	if appErr != nil {
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Bot User not found", appErr)
+		return
+	}
+	if post.UserId != string(botID) || post.ChannelId != request.ChannelId || !p.API.HasPermissionToChannel(c.UserID, post.ChannelId, model.PermissionReadChannel) {
+		p.writeError(w, r, http.StatusForbidden, errCodeForbidden, "Not allowed to act on this post", nil)
+		return
+	}
+
+	actionID, _ := request.Context[actionContextID].(string)
+	value, _ := request.Context[actionContextValue].(string)
+	connectionName, _ := request.Context[actionContextConnection].(string)
+	connection := p.getConfiguration().connectionByName(connectionName)
+	if actionID == "" || connection == nil {
+		actionEphemeral(w, "This action is no longer available.")
+		return
+	}
+
+	body := actionRequest{
+		Action:    actionID,
+		Value:     value,
+		Email:     c.User.Email,
+		PostID:    post.Id,
+		ChannelID: post.ChannelId,
+		TeamID:    request.TeamId,
+	}
+	if linked, err := p.identityForUser(connection, c.UserID); err == nil {
+		body.UserID = linked.ParabolUserID
+	}
+	var result actionResponse
+	if err := p.callParabol(c.Ctx, connection, "/mattermost/action", &body, &result); err != nil {
+		p.API.LogWarn("Parabol action failed", "action", actionID, "connection", connection.Name, "request_id", requestIDFromContext(r.Context()), "err", err.Error())
+		actionEphemeral(w, "Parabol couldn't complete the action, please try again later.")
+		return
+	}
+
+	if len(result.Update) > 0 {
+		n, err := decodeNotification(result.Update)
+		if err != nil {
+			p.API.LogWarn("Parabol returned an invalid notification update", "action", actionID, "err", err.Error())
+		} else {
+			n.resolveMentions(p.mentionsFor(connection))
+			updated := n.toPost(connection.Name)
+			post.Type = updated.Type
+			post.Message = updated.Message
+			post.SetProps(updated.GetProps())
+			if _, appErr := p.API.UpdatePost(post); appErr != nil {
+				p.API.LogError("Failed to update Parabol notification", "post_id", post.Id, "err", appErr.Error())
+			}
+		}
+	}
+	actionEphemeral(w, result.Message)
+}
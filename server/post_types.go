@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	// postTypePrefix namespaces the post types rendered by the Parabol components in the webapp.
+	postTypePrefix = "custom_parabol_"
+	// postTypeProp holds the data of a custom post type, including its version.
+	postTypeProp = "parabol"
+
+	maxPostTypeDataLength = 32 << 10
+)
+
+// Kinds of the fields of a post type.
+const (
+	fieldString = "string"
+	fieldURL    = "url"
+	fieldNumber = "number"
+	fieldArray  = "array"
+)
+
+// postTypeSchema describes one version of the data of a post type.
+type postTypeSchema struct {
+	required map[string]string
+	optional map[string]string
+}
+
+// postTypes lists the supported versions of every post type. Versions are only ever added, so
+// posts created with an older version keep rendering.
+var postTypes = map[string]map[int]postTypeSchema{
+	postTypePrefix + "meeting": {
+		1: {
+			required: map[string]string{"meetingId": fieldString, "meetingName": fieldString, "meetingUrl": fieldURL},
+			optional: map[string]string{"meetingType": fieldString, "teamName": fieldString, "facilitator": fieldString, "startedAt": fieldNumber, "endedAt": fieldNumber},
+		},
+	},
+	postTypePrefix + "poll": {
+		1: {
+			required: map[string]string{"pollId": fieldString, "title": fieldString, "options": fieldArray},
+			optional: map[string]string{"url": fieldURL, "closesAt": fieldNumber},
+		},
+	},
+	postTypePrefix + "task": {
+		1: {
+			required: map[string]string{"taskId": fieldString, "content": fieldString},
+			optional: map[string]string{"status": fieldString, "assignee": fieldString, "url": fieldURL},
+		},
+	},
+}
+
+// validatePostType checks the type and data of a notification against the schema of its version.
+// A custom type needs a plain text message, which is shown on mobile and in email notifications.
+func (n *notification) validatePostType() error {
+	if n.Type == "" {
+		if n.Data != nil {
+			return invalid("data requires a type")
+		}
+		return nil
+	}
+	versions, ok := postTypes[n.Type]
+	if !ok {
+		if !strings.HasPrefix(n.Type, postTypePrefix) {
+			return invalid("type must start with %s", postTypePrefix)
+		}
+		return invalid("type %s is not supported", n.Type)
+	}
+	if strings.TrimSpace(n.Message) == "" {
+		return invalid("message is required as plain text fallback for type %s", n.Type)
+	}
+	if n.Data == nil {
+		return invalid("data is required for type %s", n.Type)
+	}
+	if raw, err := json.Marshal(n.Data); err != nil || len(raw) > maxPostTypeDataLength {
+		return invalid("data is larger than %d bytes", maxPostTypeDataLength)
+	}
+
+	version, ok := n.Data["version"].(float64)
+	if !ok || version != float64(int(version)) {
+		return invalid("data.version must be an integer")
+	}
+	schema, ok := versions[int(version)]
+	if !ok {
+		return invalid("version %d of type %s is not supported", int(version), n.Type)
+	}
+
+	for _, field := range sortedKeys(schema.required) {
+		if _, ok := n.Data[field]; !ok {
+			return invalid("data.%s is required", field)
+		}
+	}
+	for _, field := range sortedKeys(n.Data) {
+		if field == "version" {
+			continue
+		}
+		kind, ok := schema.required[field]
+		if !ok {
+			if kind, ok = schema.optional[field]; !ok {
+				return invalid("data.%s is not part of version %d of type %s", field, int(version), n.Type)
+			}
+		}
+		if err := checkField("data."+field, kind, n.Data[field]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkField(field, kind string, value any) error {
+	switch kind {
+	case fieldString:
+		text, ok := value.(string)
+		if !ok {
+			return invalid("%s must be a string", field)
+		}
+		return checkLength(field, text, maxAttachmentText)
+	case fieldURL:
+		link, ok := value.(string)
+		if !ok || link == "" {
+			return invalid("%s must be a URL", field)
+		}
+		return checkURL(field, link)
+	case fieldNumber:
+		if _, ok := value.(float64); !ok {
+			return invalid("%s must be a number", field)
+		}
+	case fieldArray:
+		if _, ok := value.([]any); !ok {
+			return invalid("%s must be an array", field)
+		}
+	}
+	return nil
+}
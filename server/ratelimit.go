@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// rateLimitWindow is the window of the cluster wide counters.
+	rateLimitWindow   = time.Minute
+	rateLimitKVPrefix = "ratelimit_"
+
+	// bucketIdleTimeout removes local buckets which haven't been used for a while.
+	bucketIdleTimeout = 10 * time.Minute
+)
+
+// Rate limited routes.
+const (
+	rateLimitRouteNotify     = "notify"
+	rateLimitRouteGraphQL    = "graphql"
+	rateLimitRouteComponents = "components"
+	rateLimitRouteLogin      = "login"
+)
+
+// rateLimit configures the limits of a single route in requests per minute. Zero disables a
+// limit. Burst is the number of requests allowed at once, it defaults to a sixth of the rate.
+type rateLimit struct {
+	PerUser int `json:"perUser"`
+	PerIP   int `json:"perIP"`
+	Burst   int `json:"burst,omitempty"`
+}
+
+var defaultRateLimits = map[string]rateLimit{
+	rateLimitRouteNotify:     {PerIP: 600},
+	rateLimitRouteGraphQL:    {PerUser: 300, PerIP: 600},
+	rateLimitRouteComponents: {PerIP: 600},
+	rateLimitRouteLogin:      {PerUser: 30, PerIP: 120},
+}
+
+// parseRateLimits merges the JSON configured limits into the defaults.
+func parseRateLimits(raw string) (map[string]rateLimit, error) {
+	limits := make(map[string]rateLimit, len(defaultRateLimits))
+	for route, limit := range defaultRateLimits {
+		limits[route] = limit
+	}
+	if strings.TrimSpace(raw) == "" {
+		return limits, nil
+	}
+
+	var configured map[string]rateLimit
+	if err := json.Unmarshal([]byte(raw), &configured); err != nil {
+		return nil, errors.Wrap(err, "rate limits are not valid JSON")
+	}
+	for route, limit := range configured {
+		if _, ok := defaultRateLimits[route]; !ok {
+			return nil, errors.Errorf("rate limits: unknown route %q", route)
+		}
+		if limit.PerUser < 0 || limit.PerIP < 0 || limit.Burst < 0 {
+			return nil, errors.Errorf("rate limits of route %q must not be negative", route)
+		}
+		limits[route] = limit
+	}
+	return limits, nil
+}
+
+func (l rateLimit) burst(rate int) float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, float64(rate)/6)
+}
+
+// rateLimitScope is a single limit applying to a request, like the per user limit of a route.
+type rateLimitScope struct {
+	name      string
+	key       string
+	perMinute int
+	burst     float64
+}
+
+// rate returns the refill rate of the scope's bucket in tokens per second.
+func (s rateLimitScope) rate() float64 {
+	return float64(s.perMinute) / rateLimitWindow.Seconds()
+}
+
+// tokenBucket is a local token bucket refilled continuously at the configured rate.
+type tokenBucket struct {
+	tokens    float64
+	last      time.Time
+	throttled bool
+}
+
+// rateLimiter keeps the local token buckets. In a cluster the KV store is used instead so
+// every node sees the same counters.
+type rateLimiter struct {
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from the bucket of every scope if all of them have one left. Otherwise
+// nothing is taken, and the index of the first scope without a token is returned along with how
+// long to wait, or -1. The last return value is true the first time a bucket is throttled, to
+// avoid flooding the logs.
+func (l *rateLimiter) allow(scopes []rateLimitScope, now time.Time) (int, time.Duration, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastSweep) > bucketIdleTimeout {
+		for k, bucket := range l.buckets {
+			if now.Sub(bucket.last) > bucketIdleTimeout {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	buckets := make([]*tokenBucket, len(scopes))
+	for i, scope := range scopes {
+		bucket, ok := l.buckets[scope.key]
+		if !ok {
+			bucket = &tokenBucket{tokens: scope.burst, last: now}
+			l.buckets[scope.key] = bucket
+		}
+		bucket.tokens = math.Min(scope.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*scope.rate())
+		bucket.last = now
+		buckets[i] = bucket
+	}
+
+	for i, bucket := range buckets {
+		if bucket.tokens < 1 {
+			wait := time.Duration((1 - bucket.tokens) / scopes[i].rate() * float64(time.Second))
+			first := !bucket.throttled
+			bucket.throttled = true
+			return i, wait, first
+		}
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+		bucket.throttled = false
+	}
+	return -1, 0, false
+}
+
+// allowCluster counts the request in fixed windows shared through the KV store, so the limits
+// apply to the whole cluster. A window allows the rate plus the burst. The counters are only
+// increased once every scope allows the request, the return values are the ones of allow. Once
+// a window is used up its counter is written one last time to log the first rejection, later
+// requests only read it.
+func (p *Plugin) allowCluster(scopes []rateLimitScope, now time.Time) (int, time.Duration, bool, error) {
+	window := now.Truncate(rateLimitWindow)
+	wait := window.Add(rateLimitWindow).Sub(now)
+
+	for i, scope := range scopes {
+		kvKey := rateLimitKey(scope.key, window)
+		raw, appErr := p.API.KVGet(kvKey)
+		if appErr != nil {
+			return 0, 0, false, errors.Wrap(appErr, "failed to read rate limit counter")
+		}
+		var count int64
+		if raw != nil {
+			count, _ = strconv.ParseInt(string(raw), 10, 64)
+		}
+		limit := int64(scope.perMinute) + int64(scope.burst)
+		if count < limit {
+			continue
+		}
+		first := false
+		if count == limit {
+			ok, appErr := p.API.KVSetWithOptions(kvKey, []byte(strconv.FormatInt(count+1, 10)), model.PluginKVSetOptions{
+				Atomic:          true,
+				OldValue:        raw,
+				ExpireInSeconds: int64(2 * rateLimitWindow.Seconds()),
+			})
+			if appErr != nil {
+				return 0, 0, false, errors.Wrap(appErr, "failed to update rate limit counter")
+			}
+			first = ok
+		}
+		return i, wait, first, nil
+	}
+
+	for _, scope := range scopes {
+		if err := p.incrementRateLimit(rateLimitKey(scope.key, window)); err != nil {
+			return 0, 0, false, err
+		}
+	}
+	return -1, 0, false, nil
+}
+
+// incrementRateLimit counts a request in the window's counter.
+func (p *Plugin) incrementRateLimit(kvKey string) error {
+	for range 10 {
+		raw, appErr := p.API.KVGet(kvKey)
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to read rate limit counter")
+		}
+		var count int64
+		if raw != nil {
+			count, _ = strconv.ParseInt(string(raw), 10, 64)
+		}
+		ok, appErr := p.API.KVSetWithOptions(kvKey, []byte(strconv.FormatInt(count+1, 10)), model.PluginKVSetOptions{
+			Atomic:          true,
+			OldValue:        raw,
+			ExpireInSeconds: int64(2 * rateLimitWindow.Seconds()),
+		})
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to update rate limit counter")
+		}
+		if ok {
+			return nil
+		}
+	}
+	// Don't reject requests just because the counter is contended.
+	return nil
+}
+
+// rateLimitKey returns the KV key of the counter for the window. Keys which would exceed the KV
+// key length are hashed, so the counter can always be stored.
+func rateLimitKey(key string, window time.Time) string {
+	kvKey := fmt.Sprintf("%s%s_%d", rateLimitKVPrefix, key, window.Unix())
+	if len(kvKey) <= model.KeyValueKeyMaxRunes {
+		return kvKey
+	}
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s%s_%d", rateLimitKVPrefix, hex.EncodeToString(sum[:]), window.Unix())
+}
+
+func (p *Plugin) isClustered() bool {
+	config := p.API.GetConfig()
+	return config != nil && config.ClusterSettings.Enable != nil && *config.ClusterSettings.Enable
+}
+
+// rateLimited wraps a handler with the per user and per IP limits of the route.
+func (p *Plugin) rateLimited(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := p.getConfiguration().rateLimits[route]
+		if !ok {
+			limit = defaultRateLimits[route]
+		}
+
+		var scopes []rateLimitScope
+		for _, scope := range []struct {
+			name      string
+			id        string
+			perMinute int
+		}{
+			{"user", r.Header.Get("Mattermost-User-ID"), limit.PerUser},
+			{"ip", p.sourceIP(r), limit.PerIP},
+		} {
+			if scope.id == "" || scope.perMinute == 0 {
+				continue
+			}
+			scopes = append(scopes, rateLimitScope{
+				name:      scope.name,
+				key:       route + "_" + scope.name + "_" + scope.id,
+				perMinute: scope.perMinute,
+				burst:     limit.burst(scope.perMinute),
+			})
+		}
+		if len(scopes) == 0 {
+			handler(w, r)
+			return
+		}
+
+		// A request is only counted if every scope allows it, so a request rejected for its IP
+		// doesn't use up the quota of its user.
+		now := time.Now()
+		var rejected int
+		var wait time.Duration
+		var first bool
+		if p.isClustered() {
+			var err error
+			if rejected, wait, first, err = p.allowCluster(scopes, now); err != nil {
+				// Fall back to the local buckets rather than letting the request through.
+				p.API.LogWarn("Failed to apply cluster rate limit", "route", route, "err", err.Error())
+				rejected, wait, first = p.rateLimiter.allow(scopes, now)
+			}
+		} else {
+			rejected, wait, first = p.rateLimiter.allow(scopes, now)
+		}
+		if rejected >= 0 {
+			scope := scopes[rejected]
+			p.metrics.inc(metricRateLimited, route, scope.name)
+			if first {
+				p.API.LogWarn("Rate limit exceeded", "route", route, "scope", scope.name, "key", scope.key, "limit_per_minute", scope.perMinute)
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			p.writeError(w, r, http.StatusTooManyRequests, errCodeRateLimited, "Too many requests", nil)
+			return
+		}
+
+		handler(w, r)
+	}
+}
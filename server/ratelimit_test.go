@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rateLimitStep is a request at an offset from the start, and its expected outcome. Rejected is
+// the index of the rejecting scope, or -1.
+type rateLimitStep struct {
+	at       time.Duration
+	rejected int
+	wait     time.Duration
+	first    bool
+}
+
+var (
+	userScope = rateLimitScope{name: "user", key: "graphql_user_u1", perMinute: 60, burst: 3}
+	ipScope   = rateLimitScope{name: "ip", key: "graphql_ip_10.0.0.1", perMinute: 60, burst: 1}
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	for name, tc := range map[string]struct {
+		scopes []rateLimitScope
+		steps  []rateLimitStep
+	}{
+		"burst is allowed at once": {
+			scopes: []rateLimitScope{userScope},
+			steps: []rateLimitStep{
+				{rejected: -1},
+				{rejected: -1},
+				{rejected: -1},
+				{rejected: 0, wait: time.Second, first: true},
+				{rejected: 0, wait: time.Second},
+			},
+		},
+		"tokens refill at the rate": {
+			scopes: []rateLimitScope{userScope},
+			steps: []rateLimitStep{
+				{rejected: -1},
+				{rejected: -1},
+				{rejected: -1},
+				{at: 500 * time.Millisecond, rejected: 0, wait: 500 * time.Millisecond, first: true},
+				{at: time.Second, rejected: -1},
+				{at: time.Second, rejected: 0, wait: time.Second, first: true},
+			},
+		},
+		"refill is capped at the burst": {
+			scopes: []rateLimitScope{userScope},
+			steps: []rateLimitStep{
+				{rejected: -1},
+				{at: time.Hour, rejected: -1},
+				{at: time.Hour, rejected: -1},
+				{at: time.Hour, rejected: -1},
+				{at: time.Hour, rejected: 0, wait: time.Second, first: true},
+			},
+		},
+		"rejection by one scope doesn't consume the other": {
+			scopes: []rateLimitScope{userScope, ipScope},
+			steps: []rateLimitStep{
+				{rejected: -1},
+				{rejected: 1, wait: time.Second, first: true},
+				{rejected: 1, wait: time.Second},
+				{at: time.Second, rejected: -1},
+				{at: 2 * time.Second, rejected: -1},
+				{at: 3 * time.Second, rejected: -1},
+				{at: 3 * time.Second, rejected: 1, wait: time.Second, first: true},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			limiter := newRateLimiter()
+			start := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+			for i, step := range tc.steps {
+				rejected, wait, first := limiter.allow(tc.scopes, start.Add(step.at))
+				assert.Equal(t, step.rejected, rejected, "rejected scope of request %d", i)
+				assert.InDelta(t, step.wait, wait, float64(time.Millisecond), "wait of request %d", i)
+				assert.Equal(t, step.first, first, "first rejection of request %d", i)
+			}
+		})
+	}
+}
+
+func TestAllowCluster(t *testing.T) {
+	// The window allows the rate plus the burst: 60 + 3 for the user, 60 + 1 for the IP.
+	for name, tc := range map[string]struct {
+		scopes       []rateLimitScope
+		requests     int
+		at           time.Duration
+		expectCounts map[string]string
+		expectLast   rateLimitStep
+	}{
+		"within the window": {
+			scopes:       []rateLimitScope{userScope},
+			requests:     63,
+			expectCounts: map[string]string{userScope.key: "63"},
+			expectLast:   rateLimitStep{rejected: -1},
+		},
+		"first rejection is counted once": {
+			scopes:       []rateLimitScope{userScope},
+			requests:     64,
+			at:           15 * time.Second,
+			expectCounts: map[string]string{userScope.key: "64"},
+			expectLast:   rateLimitStep{rejected: 0, wait: 45 * time.Second, first: true},
+		},
+		"later rejections only read the counter": {
+			scopes:       []rateLimitScope{userScope},
+			requests:     70,
+			at:           15 * time.Second,
+			expectCounts: map[string]string{userScope.key: "64"},
+			expectLast:   rateLimitStep{rejected: 0, wait: 45 * time.Second},
+		},
+		"rejection by one scope doesn't count for the other": {
+			scopes:       []rateLimitScope{userScope, ipScope},
+			requests:     70,
+			expectCounts: map[string]string{userScope.key: "61", ipScope.key: "62"},
+			expectLast:   rateLimitStep{rejected: 1, wait: time.Minute},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := newTestAPI()
+			p := newTestPlugin(api)
+			now := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC).Add(tc.at)
+
+			var rejected int
+			var wait time.Duration
+			var first bool
+			for range tc.requests {
+				var err error
+				rejected, wait, first, err = p.allowCluster(tc.scopes, now)
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectLast, rateLimitStep{rejected: rejected, wait: wait, first: first})
+			window := now.Truncate(rateLimitWindow)
+			for key, count := range tc.expectCounts {
+				assert.Equal(t, count, string(api.kv[rateLimitKey(key, window)]), "counter of %s", key)
+			}
+		})
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	window := time.Unix(1760864400, 0)
+	assert.Equal(t, "ratelimit_login_user_u1_1760864400", rateLimitKey("login_user_u1", window))
+
+	longID := strings.Repeat("f", 200)
+	long := rateLimitKey("graphql_ip_"+longID, window)
+	assert.LessOrEqual(t, len(long), model.KeyValueKeyMaxRunes)
+	assert.Equal(t, long, rateLimitKey("graphql_ip_"+longID, window))
+	assert.NotEqual(t, long, rateLimitKey("graphql_ip_"+longID+"0", window))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Frequencies of a recurrence.
+const (
+	freqDaily   = "DAILY"
+	freqWeekly  = "WEEKLY"
+	freqMonthly = "MONTHLY"
+)
+
+const maxRecurrenceInterval = 52
+
+var rruleDays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// recurrence is the subset of an RFC 5545 RRULE supported by meeting schedules, e.g.
+// FREQ=WEEKLY;INTERVAL=2;BYDAY=FR;BYHOUR=15. Intervals are counted from the anchor, the day the
+// schedule was created. Weeks start on Monday.
+type recurrence struct {
+	Freq       string
+	Interval   int
+	ByDay      []time.Weekday
+	ByMonthDay int
+	Hour       int
+	Minute     int
+}
+
+// parseRecurrence parses an RRULE. FREQ and BYHOUR are required, INTERVAL defaults to 1 and
+// BYMINUTE to 0.
+func parseRecurrence(rule string) (*recurrence, error) {
+	r := &recurrence{Interval: 1, Hour: -1}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.ToUpper(rule), "RRULE:"), ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, errors.Errorf("invalid rule part %q, use NAME=VALUE", part)
+		}
+		var err error
+		switch name {
+		case "FREQ":
+			if value != freqDaily && value != freqWeekly && value != freqMonthly {
+				return nil, errors.New("FREQ must be DAILY, WEEKLY or MONTHLY")
+			}
+			r.Freq = value
+		case "INTERVAL":
+			r.Interval, err = parseRuleNumber(name, value, 1, maxRecurrenceInterval)
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				weekday, ok := rruleDays[day]
+				if !ok {
+					return nil, errors.Errorf("invalid BYDAY %q, use MO, TU, WE, TH, FR, SA or SU", day)
+				}
+				r.ByDay = append(r.ByDay, weekday)
+			}
+		case "BYMONTHDAY":
+			r.ByMonthDay, err = parseRuleNumber(name, value, 1, 31)
+		case "BYHOUR":
+			r.Hour, err = parseRuleNumber(name, value, 0, 23)
+		case "BYMINUTE":
+			r.Minute, err = parseRuleNumber(name, value, 0, 59)
+		default:
+			return nil, errors.Errorf("%s is not supported", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case r.Freq == "":
+		return nil, errors.New("FREQ is required")
+	case r.Hour < 0:
+		return nil, errors.New("BYHOUR is required")
+	case r.Freq == freqMonthly && len(r.ByDay) > 0:
+		return nil, errors.New("BYDAY is not supported with FREQ=MONTHLY, use BYMONTHDAY")
+	case r.Freq != freqMonthly && r.ByMonthDay != 0:
+		return nil, errors.New("BYMONTHDAY requires FREQ=MONTHLY")
+	}
+	return r, nil
+}
+
+func parseRuleNumber(name, value string, minimum, maximum int) (int, error) {
+	number, err := strconv.Atoi(value)
+	if err != nil || number < minimum || number > maximum {
+		return 0, errors.Errorf("%s must be between %d and %d", name, minimum, maximum)
+	}
+	return number, nil
+}
+
+// date returns midnight UTC of the calendar day of t, so days can be counted regardless of
+// daylight saving time.
+func date(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func daysBetween(from, to time.Time) int {
+	return int(date(to).Sub(date(from)).Hours() / 24)
+}
+
+// matches reports whether the recurrence happens on the day of slot.
+func (r *recurrence) matches(slot, anchor time.Time) bool {
+	switch r.Freq {
+	case freqDaily:
+		if daysBetween(anchor, slot)%r.Interval != 0 {
+			return false
+		}
+		return len(r.ByDay) == 0 || containsWeekday(r.ByDay, slot.Weekday())
+	case freqWeekly:
+		// Count weeks between the Mondays of both days.
+		monday := func(t time.Time) time.Time { return date(t).AddDate(0, 0, -(int(t.Weekday())+6)%7) }
+		if daysBetween(monday(anchor), monday(slot))/7%r.Interval != 0 {
+			return false
+		}
+		if len(r.ByDay) == 0 {
+			return slot.Weekday() == anchor.Weekday()
+		}
+		return containsWeekday(r.ByDay, slot.Weekday())
+	case freqMonthly:
+		months := (slot.Year()-anchor.Year())*12 + int(slot.Month()) - int(anchor.Month())
+		if months%r.Interval != 0 {
+			return false
+		}
+		day := r.ByMonthDay
+		if day == 0 {
+			day = anchor.Day()
+		}
+		// Months without the day are skipped, like RFC 5545 does.
+		return slot.Day() == day
+	}
+	return false
+}
+
+// next returns the first occurrence after the given time in the location, or the zero time if
+// there is none, e.g. for the 30th of February.
+func (r *recurrence) next(after, anchor time.Time, location *time.Location) time.Time {
+	after = after.In(location)
+	anchor = anchor.In(location)
+	maxDays := 366 * (r.Interval + 1)
+	for offset := 0; offset <= maxDays; offset++ {
+		slot := time.Date(after.Year(), after.Month(), after.Day()+offset, r.Hour, r.Minute, 0, 0, location)
+		if !slot.After(after) || daysBetween(anchor, slot) < 0 {
+			continue
+		}
+		if r.matches(slot, anchor) {
+			return slot
+		}
+	}
+	return time.Time{}
+}
+
+func containsWeekday(days []time.Weekday, day time.Weekday) bool {
+	for _, d := range days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecurrenceNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Monday, the schedule was created.
+	anchor := time.Date(2026, time.October, 19, 10, 0, 0, 0, berlin)
+
+	for name, tc := range map[string]struct {
+		rule   string
+		after  time.Time
+		expect []time.Time
+	}{
+		"every other friday": {
+			rule:  "FREQ=WEEKLY;INTERVAL=2;BYDAY=FR;BYHOUR=15",
+			after: anchor,
+			expect: []time.Time{
+				time.Date(2026, time.October, 23, 15, 0, 0, 0, berlin),
+				time.Date(2026, time.November, 6, 15, 0, 0, 0, berlin),
+				time.Date(2026, time.November, 20, 15, 0, 0, 0, berlin),
+			},
+		},
+		"weekly defaults to the day of the anchor": {
+			rule:  "FREQ=WEEKLY;BYHOUR=9;BYMINUTE=30",
+			after: anchor,
+			expect: []time.Time{
+				time.Date(2026, time.October, 26, 9, 30, 0, 0, berlin),
+				time.Date(2026, time.November, 2, 9, 30, 0, 0, berlin),
+			},
+		},
+		"daily on weekdays across daylight saving time": {
+			rule:  "FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR;BYHOUR=9",
+			after: time.Date(2026, time.October, 23, 12, 0, 0, 0, berlin),
+			expect: []time.Time{
+				time.Date(2026, time.October, 26, 9, 0, 0, 0, berlin),
+				time.Date(2026, time.October, 27, 9, 0, 0, 0, berlin),
+			},
+		},
+		"later the same day": {
+			rule:   "FREQ=DAILY;BYHOUR=11",
+			after:  anchor,
+			expect: []time.Time{time.Date(2026, time.October, 19, 11, 0, 0, 0, berlin)},
+		},
+		"monthly skips months without the day": {
+			rule:  "FREQ=MONTHLY;BYMONTHDAY=31;BYHOUR=8",
+			after: anchor,
+			expect: []time.Time{
+				time.Date(2026, time.October, 31, 8, 0, 0, 0, berlin),
+				time.Date(2026, time.December, 31, 8, 0, 0, 0, berlin),
+				time.Date(2027, time.January, 31, 8, 0, 0, 0, berlin),
+			},
+		},
+		"never": {
+			rule:   "FREQ=MONTHLY;INTERVAL=12;BYMONTHDAY=30;BYHOUR=8",
+			after:  time.Date(2026, time.February, 1, 0, 0, 0, 0, berlin),
+			expect: []time.Time{{}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rule, err := parseRecurrence(tc.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ruleAnchor := anchor
+			if tc.after.Before(anchor) {
+				ruleAnchor = tc.after
+			}
+			after := tc.after
+			for _, expect := range tc.expect {
+				next := rule.next(after, ruleAnchor, berlin)
+				if !next.Equal(expect) {
+					t.Fatalf("expected %v, got %v", expect, next)
+				}
+				after = next
+			}
+		})
+	}
+}
+
+func TestParseRecurrence(t *testing.T) {
+	for name, tc := range map[string]struct {
+		rule        string
+		expectError string
+	}{
+		"valid":                 {rule: "RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=FR;BYHOUR=15;BYMINUTE=30"},
+		"lower case":            {rule: "freq=daily;byhour=9"},
+		"missing frequency":     {rule: "BYHOUR=9", expectError: "FREQ is required"},
+		"missing hour":          {rule: "FREQ=DAILY", expectError: "BYHOUR is required"},
+		"unsupported part":      {rule: "FREQ=DAILY;BYHOUR=9;COUNT=3", expectError: "COUNT is not supported"},
+		"invalid day":           {rule: "FREQ=WEEKLY;BYDAY=XX;BYHOUR=9", expectError: `invalid BYDAY "XX", use MO, TU, WE, TH, FR, SA or SU`},
+		"interval out of range": {rule: "FREQ=DAILY;INTERVAL=0;BYHOUR=9", expectError: "INTERVAL must be between 1 and 52"},
+		"monthly by day":        {rule: "FREQ=MONTHLY;BYDAY=MO;BYHOUR=9", expectError: "BYDAY is not supported with FREQ=MONTHLY, use BYMONTHDAY"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseRecurrence(tc.rule)
+			if tc.expectError == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.expectError != "" && (err == nil || err.Error() != tc.expectError) {
+				t.Fatalf("expected error %q, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+const (
+	maxReflectionLength = 2000
+	reflectionTimeout   = 10 * time.Second
+)
+
+// reflectionRequest adds an anonymous reflection to the upcoming retrospective of the team. Email
+// and UserID are of the Mattermost user submitting it, who must be a member of the Parabol team.
+// The author of a message added as reflection is never sent.
+type reflectionRequest struct {
+	TeamID    string `json:"teamId"`
+	ChannelID string `json:"channelId"`
+	Content   string `json:"content"`
+	Email     string `json:"email"`
+	UserID    string `json:"userId,omitempty"`
+}
+
+// reflectionResponse names the retrospective the reflection was added to. MeetingID is empty if
+// the team has no upcoming retrospective.
+type reflectionResponse struct {
+	MeetingID   string `json:"meetingId"`
+	MeetingName string `json:"meetingName"`
+	MeetingURL  string `json:"meetingUrl"`
+}
+
+// addReflection submits the text as reflection on behalf of the user and returns the confirmation
+// shown to them only.
+func (p *Plugin) addReflection(ctx context.Context, user *model.User, channel *model.Channel, text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "A reflection needs some text.", nil
+	}
+	if utf8.RuneCountInString(text) > maxReflectionLength {
+		return fmt.Sprintf("A reflection can't be longer than %d characters.", maxReflectionLength), nil
+	}
+	teamID := channel.TeamId
+	connection, err := p.getConfiguration().connectionForTeam(teamID)
+	if err != nil {
+		return "No Parabol instance is configured for this team.", nil
+	}
+
+	request := reflectionRequest{
+		TeamID:    teamID,
+		ChannelID: channel.Id,
+		Content:   text,
+		Email:     user.Email,
+	}
+	if linked, err := p.identityForUser(connection, user.Id); err == nil {
+		request.UserID = linked.ParabolUserID
+	}
+	ctx, cancel := context.WithTimeout(ctx, reflectionTimeout)
+	defer cancel()
+	var result reflectionResponse
+	if err := p.callParabol(ctx, connection, "/mattermost/reflection", &request, &result); err != nil {
+		return "", err
+	}
+	if result.MeetingID == "" {
+		return "Your team has no upcoming retrospective to add the reflection to.", nil
+	}
+	// The reflection was added, a link Parabol shouldn't have sent is just left out.
+	if result.MeetingURL == "" || checkURL("meetingUrl", result.MeetingURL) != nil {
+		p.API.LogWarn("Parabol sent an invalid retrospective URL", "meeting_id", result.MeetingID)
+		return fmt.Sprintf("Added your anonymous reflection to %s.", escapeLinkText(result.MeetingName)), nil
+	}
+	return fmt.Sprintf("Added your anonymous reflection to [%s](%s).", escapeLinkText(result.MeetingName), result.MeetingURL), nil
+}
+
+// sendReflectionConfirmation tells the user the outcome in the channel, visible to them only.
+func (p *Plugin) sendReflectionConfirmation(userID, channelID, message string) {
+	botID, appErr := p.API.KVGet(botUserID)
+	if appErr != nil {
+		p.API.LogError("Failed to get bot user", "err", appErr.Error())
+		return
+	}
+	p.API.SendEphemeralPost(userID, &model.Post{
+		ChannelId: channelID,
+		UserId:    string(botID),
+		Message:   message,
+	})
+}
+
+// reflectPost adds the message of a post as reflection, it is the target of the "Add as
+// reflection" message action. With thread set, the messages of the post's whole thread are added
+// as a single reflection, for the "Add thread as reflection" action. The confirmation is sent as
+// ephemeral post.
+func (p *Plugin) reflectPost(c *Context, w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		PostID string `json:"postId"`
+		Thread bool   `json:"thread,omitempty"`
+	}
+	if err := getJSON(r.Body, &body); err != nil {
+		p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Error parsing body", err)
+		return
+	}
+	if c.User == nil {
+		p.writeError(w, r, http.StatusUnauthorized, errCodeUnauthorized, "User not found", nil)
+		return
+	}
+	post, appErr := p.API.GetPost(body.PostID)
+	if appErr != nil || !p.API.HasPermissionToChannel(c.UserID, post.ChannelId, model.PermissionReadChannel) {
+		p.writeError(w, r, http.StatusNotFound, errCodeNotFound, "Post not found", appErr)
+		return
+	}
+	text := post.Message
+	if body.Thread {
+		thread, appErr := p.API.GetPostThread(post.Id)
+		if appErr != nil {
+			p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error getting thread", appErr)
+			return
+		}
+		text = threadText(thread)
+	} else if post.IsSystemMessage() {
+		p.writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "System messages can't be added as reflection", nil)
+		return
+	}
+	channel, appErr := p.API.GetChannel(post.ChannelId)
+	if appErr != nil {
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error getting channel", appErr)
+		return
+	}
+
+	message, err := p.addReflection(c.Ctx, c.User, channel, text)
+	if err != nil {
+		p.API.LogWarn("Failed to add reflection", "request_id", requestIDFromContext(r.Context()), "err", err.Error())
+		message = "Parabol couldn't add the reflection, please try again later."
+	}
+	p.sendReflectionConfirmation(c.UserID, channel.Id, message)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// threadText joins the messages of the thread, oldest first, separated by blank lines. Deleted
+// posts and system messages are left out. Like for a single message, the authors aren't named.
+func threadText(thread *model.PostList) string {
+	posts := make([]*model.Post, 0, len(thread.Posts))
+	for _, post := range thread.Posts {
+		if post.DeleteAt == 0 && !post.IsSystemMessage() && strings.TrimSpace(post.Message) != "" {
+			posts = append(posts, post)
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].CreateAt < posts[j].CreateAt })
+	messages := make([]string, len(posts))
+	for i, post := range posts {
+		messages[i] = strings.TrimSpace(post.Message)
+	}
+	return strings.Join(messages, "\n\n")
+}
+
+// executeReflectCommand handles `/parabol reflect <text>`. The text is taken verbatim from the
+// command, so line breaks are kept.
+func (p *Plugin) executeReflectCommand(args *model.CommandArgs) *model.CommandResponse {
+	_, text, _ := strings.Cut(strings.TrimSpace(args.Command), "reflect")
+	if strings.TrimSpace(text) == "" {
+		return ephemeralResponse("Usage: `/parabol reflect <text>`")
+	}
+	user, appErr := p.API.GetUser(args.UserId)
+	if appErr != nil {
+		return ephemeralResponse("Failed to get your user.")
+	}
+	channel, appErr := p.API.GetChannel(args.ChannelId)
+	if appErr != nil {
+		return ephemeralResponse("Failed to get the channel.")
+	}
+	if channel.TeamId == "" {
+		channel.TeamId = args.TeamId
+	}
+
+	message, err := p.addReflection(context.Background(), user, channel, text)
+	if err != nil {
+		p.API.LogWarn("Failed to add reflection", "user_id", args.UserId, "err", err.Error())
+		return ephemeralResponse("Parabol couldn't add the reflection, please try again later.")
+	}
+	return ephemeralResponse(message)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThreadText(t *testing.T) {
+	for name, tc := range map[string]struct {
+		posts  []*model.Post
+		expect string
+	}{
+		"oldest first": {
+			posts: []*model.Post{
+				{Id: "reply2", CreateAt: 3, Message: "Or cache the build"},
+				{Id: "root", CreateAt: 1, Message: "Deploys take forever"},
+				{Id: "reply1", CreateAt: 2, Message: "  Split the pipeline\n"},
+			},
+			expect: "Deploys take forever\n\nSplit the pipeline\n\nOr cache the build",
+		},
+		"deleted, system and empty posts are left out": {
+			posts: []*model.Post{
+				{Id: "root", CreateAt: 1, Message: "Deploys take forever"},
+				{Id: "deleted", CreateAt: 2, Message: "Nevermind", DeleteAt: 5},
+				{Id: "joined", CreateAt: 3, Message: "alice joined the channel", Type: model.PostTypeJoinChannel},
+				{Id: "file", CreateAt: 4, Message: " "},
+			},
+			expect: "Deploys take forever",
+		},
+		"nothing left": {
+			posts: []*model.Post{
+				{Id: "joined", CreateAt: 1, Message: "alice joined the channel", Type: model.PostTypeJoinChannel},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			thread := model.NewPostList()
+			for _, post := range tc.posts {
+				thread.AddPost(post)
+				thread.AddOrder(post.Id)
+			}
+			assert.Equal(t, tc.expect, threadText(thread))
+		})
+	}
+}
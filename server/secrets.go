@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// secretKeyPrefix prefixes the KV keys of encrypted secrets, followed by the connection name
+	// and the field.
+	secretKeyPrefix = "secret_"
+
+	// secretPlaceholder replaces secrets in the plugin configuration once they are stored in KV.
+	// It is the value the System Console shows for masked settings anyway.
+	secretPlaceholder = model.FakeSetting
+)
+
+// secretFields returns the secret fields of a connection by name. Private keys given as a file
+// path aren't secret and are left in the configuration.
+func secretFields(connection *parabolConnection) map[string]*string {
+	fields := map[string]*string{
+		"token":          &connection.Token,
+		"secondaryToken": &connection.SecondaryToken,
+	}
+	if connection.PrivateKey == secretPlaceholder || strings.HasPrefix(strings.TrimSpace(connection.PrivateKey), "-----BEGIN") {
+		fields["privateKey"] = &connection.PrivateKey
+	}
+	return fields
+}
+
+// encryptionKey derives the key secrets are encrypted with from the server's at rest encryption
+// key, so the KV store alone isn't enough to recover them.
+func (p *Plugin) encryptionKey() ([]byte, error) {
+	config := p.API.GetUnsanitizedConfig()
+	if config == nil || config.SqlSettings.AtRestEncryptKey == nil || *config.SqlSettings.AtRestEncryptKey == "" {
+		return nil, errors.New("the server has no at rest encryption key")
+	}
+	key := sha256.Sum256([]byte(manifest.Id + ":parabol-secrets:" + *config.SqlSettings.AtRestEncryptKey))
+	return key[:], nil
+}
+
+func encrypt(key []byte, plaintext string) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, []byte(plaintext), nil), nil
+}
+
+func decrypt(key []byte, ciphertext []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// resolveSecrets replaces placeholders in the connections with the decrypted secrets from KV. It
+// returns true if the configuration still holds plain text secrets, which maskSecrets moves to KV.
+func (p *Plugin) resolveSecrets(connections []*parabolConnection) (bool, error) {
+	var key []byte
+	plaintext := false
+	for _, connection := range connections {
+		for field, value := range secretFields(connection) {
+			if *value == "" {
+				continue
+			}
+			if *value != secretPlaceholder {
+				plaintext = true
+				continue
+			}
+
+			if key == nil {
+				var err error
+				if key, err = p.encryptionKey(); err != nil {
+					return false, err
+				}
+			}
+			stored, appErr := p.API.KVGet(secretKeyPrefix + connection.Name + "_" + field)
+			if appErr != nil {
+				return false, errors.Wrap(appErr, "failed to load secret")
+			}
+			if stored == nil {
+				return false, errors.Errorf("the %s of Parabol connection %q is missing, enter it again", field, connection.Name)
+			}
+			decrypted, err := decrypt(key, stored)
+			if err != nil {
+				return false, errors.Errorf("the %s of Parabol connection %q can't be decrypted, enter it again", field, connection.Name)
+			}
+			*value = decrypted
+		}
+	}
+	return plaintext, nil
+}
+
+// storeSecrets encrypts the plain text secrets of the connections into KV and deletes the cleared
+// ones. The returned function restores the previous values, in case the configuration referring
+// to the stored secrets can't be saved.
+func (p *Plugin) storeSecrets(connections []*parabolConnection) (func(), error) {
+	previous := make(map[string][]byte)
+	restore := func() {
+		for kvKey, value := range previous {
+			var appErr *model.AppError
+			if value == nil {
+				appErr = p.API.KVDelete(kvKey)
+			} else {
+				appErr = p.API.KVSet(kvKey, value)
+			}
+			if appErr != nil {
+				p.API.LogError("Failed to restore secret", "key", kvKey, "err", appErr.Error())
+			}
+		}
+	}
+
+	var key []byte
+	for _, connection := range connections {
+		for field, value := range secretFields(connection) {
+			if *value == secretPlaceholder {
+				continue
+			}
+			kvKey := secretKeyPrefix + connection.Name + "_" + field
+			stored, appErr := p.API.KVGet(kvKey)
+			if appErr != nil {
+				restore()
+				return nil, errors.Wrap(appErr, "failed to load secret")
+			}
+			if *value == "" {
+				if stored != nil {
+					previous[kvKey] = stored
+					if appErr := p.API.KVDelete(kvKey); appErr != nil {
+						restore()
+						return nil, errors.Wrap(appErr, "failed to delete secret")
+					}
+				}
+				continue
+			}
+
+			if key == nil {
+				var err error
+				if key, err = p.encryptionKey(); err != nil {
+					restore()
+					return nil, err
+				}
+			}
+			encrypted, err := encrypt(key, *value)
+			if err != nil {
+				restore()
+				return nil, errors.Wrap(err, "failed to encrypt secret")
+			}
+			previous[kvKey] = stored
+			if appErr := p.API.KVSet(kvKey, encrypted); appErr != nil {
+				restore()
+				return nil, errors.Wrap(appErr, "failed to store secret")
+			}
+		}
+	}
+	return restore, nil
+}
+
+// saveWithSecrets stores the secrets of the connections in KV, masks them and saves the plugin
+// settings returned by updates. The secrets are stored first, since saving validates the new
+// configuration against them, and restored if the configuration can't be saved.
+func (p *Plugin) saveWithSecrets(connections []*parabolConnection, updates func() (map[string]any, error)) error {
+	restore, err := p.storeSecrets(connections)
+	if err != nil {
+		return err
+	}
+	for _, connection := range connections {
+		maskConnection(connection)
+	}
+	settings, err := updates()
+	if err == nil {
+		err = p.savePluginSettings(settings)
+	}
+	if err != nil {
+		restore()
+		return err
+	}
+	return nil
+}
+
+// maskConnection replaces the secrets of the connection by the placeholder.
+func maskConnection(connection *parabolConnection) {
+	for _, value := range secretFields(connection) {
+		if *value != "" {
+			*value = secretPlaceholder
+		}
+	}
+}
+
+// maskSecrets moves the plain text secrets of the persisted plugin configuration to KV and
+// replaces them by the placeholder. It runs after OnConfigurationChange, which must not save the
+// configuration itself, and reloads the configuration in case it was masked in the meantime.
+func (p *Plugin) maskSecrets() {
+	config := new(configuration)
+	if err := p.API.LoadPluginConfiguration(config); err != nil {
+		p.API.LogError("Failed to load plugin configuration", "err", err.Error())
+		return
+	}
+	connections, err := parseConnections(config)
+	if err != nil {
+		p.API.LogError("Failed to remove Parabol secrets from the configuration", "reason", err.Error())
+		return
+	}
+	plaintext := false
+	for _, connection := range connections {
+		for _, value := range secretFields(connection) {
+			plaintext = plaintext || (*value != "" && *value != secretPlaceholder)
+		}
+	}
+	if !plaintext {
+		return
+	}
+
+	err = p.saveWithSecrets(connections, func() (map[string]any, error) {
+		updates := map[string]any{}
+		additional := make([]*parabolConnection, 0, len(connections))
+		for _, connection := range connections {
+			if connection.Name == defaultConnectionName {
+				updates["ParabolToken"] = connection.Token
+				updates["ParabolSecondaryToken"] = connection.SecondaryToken
+				updates["PrivateKey"] = connection.PrivateKey
+				continue
+			}
+			additional = append(additional, connection)
+		}
+		if strings.TrimSpace(config.Connections) != "" {
+			raw, err := json.Marshal(additional)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to serialize connections")
+			}
+			updates["Connections"] = string(raw)
+		}
+		return updates, nil
+	})
+	if err != nil {
+		p.API.LogError("Failed to remove Parabol secrets from the configuration", "reason", err.Error())
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	// Embed the time zone database, servers don't necessarily have one installed.
+	_ "time/tzdata"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+	"github.com/pkg/errors"
+)
+
+const (
+	standupPrefix   = "standup_schedule_"
+	standupIndexKey = "standup_index"
+	standupJobKey   = "standup_job"
+
+	// standupGracePeriod is how late a reminder may still be posted, e.g. after a restart.
+	standupGracePeriod = 10 * time.Minute
+	standupTimeout     = 30 * time.Second
+
+	usersPageSize = 200
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// standupSchedule reminds a channel of its Parabol standup at a local time on some weekdays.
+type standupSchedule struct {
+	ChannelID string         `json:"channelId"`
+	Time      string         `json:"time"`
+	TimeZone  string         `json:"timeZone"`
+	Weekdays  []time.Weekday `json:"weekdays"`
+	CreatedBy string         `json:"createdBy"`
+	// LastRun is the slot of the last reminder in milliseconds, so every slot is posted once.
+	LastRun int64 `json:"lastRun,omitempty"`
+	// LastPostID is the most recent reminder, replies to it are standup responses.
+	LastPostID string `json:"lastPostId,omitempty"`
+	MeetingID  string `json:"meetingId,omitempty"`
+}
+
+// standupRequest asks Parabol for the active standup of a channel.
+type standupRequest struct {
+	ChannelID string   `json:"channelId"`
+	TeamID    string   `json:"teamId"`
+	Emails    []string `json:"emails"`
+}
+
+// standupResponse names the active standup and the users who haven't responded yet.
+type standupResponse struct {
+	MeetingID   string   `json:"meetingId"`
+	MeetingName string   `json:"meetingName"`
+	MeetingURL  string   `json:"meetingUrl"`
+	Pending     []string `json:"pending"`
+}
+
+// parseWeekdays accepts a comma separated list of days, "weekdays" or "daily".
+func parseWeekdays(value string) ([]time.Weekday, error) {
+	switch strings.ToLower(value) {
+	case "daily":
+		return []time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday}, nil
+	case "weekdays":
+		return []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}, nil
+	}
+	seen := make(map[time.Weekday]bool)
+	var days []time.Weekday
+	for _, name := range strings.Split(strings.ToLower(value), ",") {
+		day, ok := weekdayNames[strings.TrimSpace(name)]
+		if !ok {
+			return nil, errors.Errorf("unknown day %q, use mon, tue, wed, thu, fri, sat or sun", name)
+		}
+		if !seen[day] {
+			seen[day] = true
+			days = append(days, day)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i] < days[j] })
+	return days, nil
+}
+
+func formatWeekdays(days []time.Weekday) string {
+	names := make([]string, 0, len(days))
+	for _, day := range days {
+		names = append(names, day.String()[:3])
+	}
+	return strings.Join(names, ", ")
+}
+
+// parseClock parses a 24h HH:MM time.
+func parseClock(value string) (hour, minute int, err error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid time %q, use HH:MM", value)
+	}
+	return parsed.Hour(), parsed.Minute(), nil
+}
+
+// lastSlot returns the most recent time at or before now the schedule was due, or the zero time if
+// there was none within the last week.
+func (s *standupSchedule) lastSlot(now time.Time) time.Time {
+	location, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return time.Time{}
+	}
+	hour, minute, err := parseClock(s.Time)
+	if err != nil {
+		return time.Time{}
+	}
+	local := now.In(location)
+	for offset := 0; offset < 8; offset++ {
+		day := local.AddDate(0, 0, -offset)
+		slot := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, location)
+		if slot.After(now) {
+			continue
+		}
+		if containsWeekday(s.Weekdays, slot.Weekday()) {
+			return slot
+		}
+	}
+	return time.Time{}
+}
+
+func (p *Plugin) getStandupSchedule(channelID string) (*standupSchedule, error) {
+	raw, appErr := p.API.KVGet(standupPrefix + channelID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to read standup schedule")
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	var schedule standupSchedule
+	if err := json.Unmarshal(raw, &schedule); err != nil {
+		return nil, errors.Wrap(err, "invalid standup schedule")
+	}
+	return &schedule, nil
+}
+
+func (p *Plugin) saveStandupSchedule(schedule *standupSchedule) error {
+	raw, err := json.Marshal(schedule)
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize standup schedule")
+	}
+	if appErr := p.API.KVSet(standupPrefix+schedule.ChannelID, raw); appErr != nil {
+		return errors.Wrap(appErr, "failed to store standup schedule")
+	}
+	return p.addToIndex(standupIndexKey, standupPrefix, schedule.ChannelID)
+}
+
+// updateStandupSchedule applies update to the stored schedule of the channel, retrying if it was
+// changed concurrently. It returns false without calling update if the schedule was removed.
+func (p *Plugin) updateStandupSchedule(channelID string, update func(schedule *standupSchedule)) (bool, error) {
+	for range 10 {
+		raw, appErr := p.API.KVGet(standupPrefix + channelID)
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "failed to read standup schedule")
+		}
+		if raw == nil {
+			return false, nil
+		}
+		var schedule standupSchedule
+		if err := json.Unmarshal(raw, &schedule); err != nil {
+			return false, errors.Wrap(err, "invalid standup schedule")
+		}
+		update(&schedule)
+		updated, err := json.Marshal(&schedule)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to serialize standup schedule")
+		}
+		ok, appErr := p.API.KVSetWithOptions(standupPrefix+channelID, updated, model.PluginKVSetOptions{Atomic: true, OldValue: raw})
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "failed to store standup schedule")
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, errors.New("too much contention updating standup schedule")
+}
+
+func (p *Plugin) deleteStandupSchedule(channelID string) error {
+	if appErr := p.API.KVDelete(standupPrefix + channelID); appErr != nil {
+		return errors.Wrap(appErr, "failed to delete standup schedule")
+	}
+	return p.removeFromIndex(standupIndexKey, standupPrefix, channelID)
+}
+
+func (p *Plugin) listStandupSchedules() ([]*standupSchedule, error) {
+	channelIDs, err := p.readIndex(standupIndexKey, standupPrefix)
+	if err != nil {
+		return nil, err
+	}
+	schedules := make([]*standupSchedule, 0, len(channelIDs))
+	for _, channelID := range channelIDs {
+		schedule, err := p.getStandupSchedule(channelID)
+		if err != nil {
+			p.API.LogWarn("Skipping invalid standup schedule", "channel_id", channelID, "err", err.Error())
+			continue
+		}
+		if schedule == nil {
+			if err := p.removeFromIndex(standupIndexKey, standupPrefix, channelID); err != nil {
+				p.API.LogWarn("Failed to remove standup schedule from the index", "channel_id", channelID, "err", err.Error())
+			}
+			continue
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, nil
+}
+
+// startStandupReminders schedules the cluster wide job posting standup reminders. It runs on one
+// node at a time, at the start of every minute.
+func (p *Plugin) startStandupReminders() error {
+	job, err := cluster.Schedule(p.API, standupJobKey, cluster.MakeWaitForRoundedInterval(time.Minute), p.runStandupReminders)
+	if err != nil {
+		return errors.Wrap(err, "failed to schedule standup reminders")
+	}
+	p.standupJob = job
+	return nil
+}
+
+func (p *Plugin) runStandupReminders() {
+	schedules, err := p.listStandupSchedules()
+	if err != nil {
+		p.API.LogError("Failed to read standup schedules", "err", err.Error())
+		return
+	}
+	now := time.Now()
+	for _, schedule := range schedules {
+		slot := schedule.lastSlot(now)
+		if slot.IsZero() || slot.UnixMilli() <= schedule.LastRun || now.Sub(slot) > standupGracePeriod {
+			continue
+		}
+		if err := p.remindStandup(schedule); err != nil {
+			// The reminder is tried again on the next run within the grace period.
+			p.API.LogWarn("Failed to post standup reminder", "channel_id", schedule.ChannelID, "err", err.Error())
+			continue
+		}
+		// The schedule is read again, so changes made while Parabol was asked aren't undone.
+		if _, err := p.updateStandupSchedule(schedule.ChannelID, func(stored *standupSchedule) {
+			stored.LastRun = slot.UnixMilli()
+			stored.LastPostID = schedule.LastPostID
+			stored.MeetingID = schedule.MeetingID
+		}); err != nil {
+			p.API.LogError("Failed to update standup schedule", "channel_id", schedule.ChannelID, "err", err.Error())
+		}
+	}
+}
+
+// channelUsers returns the active human members of the channel.
+func (p *Plugin) channelUsers(channelID string) ([]*model.User, error) {
+	var users []*model.User
+	for page := 0; ; page++ {
+		pageUsers, appErr := p.API.GetUsersInChannel(channelID, model.ChannelSortByUsername, page, usersPageSize)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to get channel members")
+		}
+		for _, user := range pageUsers {
+			if !user.IsBot && user.DeleteAt == 0 {
+				users = append(users, user)
+			}
+		}
+		if len(pageUsers) < usersPageSize {
+			return users, nil
+		}
+	}
+}
+
+// remindStandup asks Parabol for the active standup and reminds the members of the channel who
+// haven't responded yet. Archived channels are skipped, the reminders resume once the channel is
+// restored.
+func (p *Plugin) remindStandup(schedule *standupSchedule) error {
+	channel, appErr := p.API.GetChannel(schedule.ChannelID)
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to get channel")
+	}
+	if channel.DeleteAt != 0 {
+		p.API.LogDebug("Skipping standup reminder of archived channel", "channel_id", channel.Id)
+		return nil
+	}
+	connection, err := p.getConfiguration().connectionForTeam(channel.TeamId)
+	if err != nil {
+		return err
+	}
+	users, err := p.channelUsers(channel.Id)
+	if err != nil {
+		return err
+	}
+	usersByEmail := make(map[string]*model.User, len(users))
+	request := standupRequest{ChannelID: channel.Id, TeamID: channel.TeamId, Emails: make([]string, 0, len(users))}
+	for _, user := range users {
+		usersByEmail[strings.ToLower(user.Email)] = user
+		request.Emails = append(request.Emails, user.Email)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), standupTimeout)
+	defer cancel()
+	var standup standupResponse
+	if err := p.callParabol(ctx, connection, "/mattermost/standup", &request, &standup); err != nil {
+		return err
+	}
+	if standup.MeetingURL == "" {
+		p.API.LogDebug("No active standup for channel", "channel_id", channel.Id)
+		return nil
+	}
+	if err := checkURL("meetingUrl", standup.MeetingURL); err != nil {
+		return err
+	}
+
+	var mentions []string
+	for _, email := range standup.Pending {
+		if user, ok := usersByEmail[strings.ToLower(email)]; ok {
+			mentions = append(mentions, "@"+user.Username)
+		}
+	}
+	if len(mentions) == 0 {
+		return nil
+	}
+	sort.Strings(mentions)
+
+	name := standup.MeetingName
+	if name == "" {
+		name = "standup"
+	}
+	post, err := p.createBotPost(&model.Post{
+		ChannelId: channel.Id,
+		Message: fmt.Sprintf("%s it's time for [%s](%s)! Respond in Parabol or reply to this post.",
+			strings.Join(mentions, " "), escapeLinkText(name), standup.MeetingURL),
+	})
+	if err != nil {
+		return err
+	}
+	schedule.LastPostID = post.Id
+	schedule.MeetingID = standup.MeetingID
+	return nil
+}
+
+// canManageChannel reports whether the user may change the settings of the channel.
+func (p *Plugin) canManageChannel(userID string, channel *model.Channel) bool {
+	permission := model.PermissionManagePublicChannelProperties
+	if channel.Type == model.ChannelTypePrivate {
+		permission = model.PermissionManagePrivateChannelProperties
+	}
+	return p.API.HasPermissionToChannel(userID, channel.Id, permission)
+}
+
+// executeStandupCommand handles `/parabol standup ...` for the current channel.
+func (p *Plugin) executeStandupCommand(args *model.CommandArgs, fields []string) *model.CommandResponse {
+	const usage = "Usage: `/parabol standup set <HH:MM> <mon,tue,...|weekdays|daily> [time zone]`, `/parabol standup show` or `/parabol standup remove`"
+	if len(fields) == 0 {
+		return ephemeralResponse(usage)
+	}
+
+	channel, appErr := p.API.GetChannel(args.ChannelId)
+	if appErr != nil {
+		return ephemeralResponse("Failed to get the channel.")
+	}
+	if channel.IsGroupOrDirect() {
+		return ephemeralResponse("Standup reminders can only be scheduled in public or private channels.")
+	}
+
+	switch fields[0] {
+	case "show":
+		schedule, err := p.getStandupSchedule(channel.Id)
+		if err != nil {
+			p.API.LogError("Failed to read standup schedule", "channel_id", channel.Id, "err", err.Error())
+			return ephemeralResponse("Failed to read the standup schedule.")
+		}
+		if schedule == nil {
+			return ephemeralResponse("No standup reminder is scheduled in this channel.")
+		}
+		return ephemeralResponse(fmt.Sprintf("Standup reminders are posted at %s (%s) on %s.", schedule.Time, schedule.TimeZone, formatWeekdays(schedule.Weekdays)))
+
+	case "set":
+		if !p.canManageChannel(args.UserId, channel) {
+			return ephemeralResponse("You need permission to manage this channel to schedule standup reminders.")
+		}
+		if len(fields) < 3 || len(fields) > 4 {
+			return ephemeralResponse(usage)
+		}
+		if _, _, err := parseClock(fields[1]); err != nil {
+			return ephemeralResponse(err.Error())
+		}
+		weekdays, err := parseWeekdays(fields[2])
+		if err != nil {
+			return ephemeralResponse(err.Error())
+		}
+		timeZone := "UTC"
+		if user, appErr := p.API.GetUser(args.UserId); appErr == nil && user.GetPreferredTimezone() != "" {
+			timeZone = user.GetPreferredTimezone()
+		}
+		if len(fields) == 4 {
+			timeZone = fields[3]
+		}
+		if _, err := time.LoadLocation(timeZone); err != nil {
+			return ephemeralResponse(fmt.Sprintf("Unknown time zone `%s`, use a name like `Europe/Berlin`.", timeZone))
+		}
+		if _, err := p.getConfiguration().connectionForTeam(channel.TeamId); err != nil {
+			return ephemeralResponse("No Parabol instance is configured for this team.")
+		}
+
+		existing, err := p.getStandupSchedule(channel.Id)
+		if err != nil {
+			p.API.LogError("Failed to read standup schedule", "channel_id", channel.Id, "err", err.Error())
+			return ephemeralResponse("Failed to read the standup schedule.")
+		}
+		schedule := &standupSchedule{
+			ChannelID: channel.Id,
+			Time:      fields[1],
+			TimeZone:  timeZone,
+			Weekdays:  weekdays,
+			CreatedBy: args.UserId,
+			// Don't remind of a slot which already passed today.
+			LastRun: model.GetMillis(),
+		}
+		if existing != nil {
+			// Replies to the latest reminder still count for its standup.
+			schedule.LastPostID = existing.LastPostID
+			schedule.MeetingID = existing.MeetingID
+		}
+		if err := p.saveStandupSchedule(schedule); err != nil {
+			p.API.LogError("Failed to store standup schedule", "channel_id", channel.Id, "err", err.Error())
+			return ephemeralResponse("Failed to store the standup schedule.")
+		}
+		return ephemeralResponse(fmt.Sprintf("Standup reminders will be posted at %s (%s) on %s.", schedule.Time, schedule.TimeZone, formatWeekdays(schedule.Weekdays)))
+
+	case "remove":
+		if !p.canManageChannel(args.UserId, channel) {
+			return ephemeralResponse("You need permission to manage this channel to remove standup reminders.")
+		}
+		if err := p.deleteStandupSchedule(channel.Id); err != nil {
+			p.API.LogError("Failed to delete standup schedule", "channel_id", channel.Id, "err", err.Error())
+			return ephemeralResponse("Failed to remove the standup schedule.")
+		}
+		return ephemeralResponse("Standup reminders were removed from this channel.")
+
+	default:
+		return ephemeralResponse(usage)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+const (
+	standupReplyTimeout  = 10 * time.Second
+	standupReplyReaction = "white_check_mark"
+)
+
+// standupSection matches a line starting a section of a standup reply, like "Yesterday:",
+// "**Today**" or "### Blockers". Text after the heading belongs to the section. A line starting
+// with the plain word is only a heading without more text, so "Today I learned" is none.
+var standupSection = regexp.MustCompile(`(?i)^\s*(#{1,6}\s*)?(\*\*|__)?(yesterday|today|blockers?)\s*(:)?\s*(?:\*\*|__)?\s*(:)?\s*(.*)$`)
+
+// standupReply is a reply to a standup reminder. Without sections the whole text is the content.
+type standupReply struct {
+	Content   string `json:"content"`
+	Yesterday string `json:"yesterday,omitempty"`
+	Today     string `json:"today,omitempty"`
+	Blockers  string `json:"blockers,omitempty"`
+}
+
+// standupReplyRequest submits a standup response to Parabol on behalf of a user.
+type standupReplyRequest struct {
+	MeetingID string       `json:"meetingId"`
+	ChannelID string       `json:"channelId"`
+	PostID    string       `json:"postId"`
+	Email     string       `json:"email"`
+	UserID    string       `json:"userId,omitempty"`
+	Response  standupReply `json:"response"`
+}
+
+// parseStandupReply splits the optional Yesterday, Today and Blockers sections of a reply.
+func parseStandupReply(message string) standupReply {
+	reply := standupReply{Content: strings.TrimSpace(message)}
+	sections := make(map[string][]string)
+	current := ""
+	for _, line := range strings.Split(message, "\n") {
+		match := standupSection.FindStringSubmatch(line)
+		if match != nil && (match[1] != "" || match[2] != "" || match[4] != "" || match[5] != "" || match[6] == "") {
+			current = strings.TrimSuffix(strings.ToLower(match[3]), "s")
+			if match[6] != "" {
+				sections[current] = append(sections[current], match[6])
+			}
+			continue
+		}
+		if current != "" {
+			sections[current] = append(sections[current], line)
+		}
+	}
+	reply.Yesterday = strings.TrimSpace(strings.Join(sections["yesterday"], "\n"))
+	reply.Today = strings.TrimSpace(strings.Join(sections["today"], "\n"))
+	reply.Blockers = strings.TrimSpace(strings.Join(sections["blocker"], "\n"))
+	return reply
+}
+
+// MessageHasBeenPosted submits replies to the latest standup reminder of a channel as standup
+// responses. The reply gets a checkmark once Parabol accepted it.
+func (p *Plugin) MessageHasBeenPosted(_ *plugin.Context, post *model.Post) {
+	if post.RootId == "" || post.IsSystemMessage() || strings.TrimSpace(post.Message) == "" {
+		return
+	}
+	schedule, err := p.getStandupSchedule(post.ChannelId)
+	if err != nil {
+		p.API.LogError("Failed to read standup schedule", "channel_id", post.ChannelId, "err", err.Error())
+		return
+	}
+	if schedule == nil || schedule.LastPostID != post.RootId || schedule.MeetingID == "" {
+		return
+	}
+	botID, appErr := p.API.KVGet(botUserID)
+	if appErr != nil || post.UserId == string(botID) {
+		return
+	}
+	user, appErr := p.API.GetUser(post.UserId)
+	if appErr != nil || user.IsBot {
+		return
+	}
+
+	connection, err := p.connectionForChannel(post.ChannelId)
+	if err == nil {
+		request := standupReplyRequest{
+			MeetingID: schedule.MeetingID,
+			ChannelID: post.ChannelId,
+			PostID:    post.Id,
+			Email:     user.Email,
+			Response:  parseStandupReply(post.Message),
+		}
+		if linked, err := p.identityForUser(connection, user.Id); err == nil {
+			request.UserID = linked.ParabolUserID
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), standupReplyTimeout)
+		defer cancel()
+		err = p.callParabol(ctx, connection, "/mattermost/standup/response", &request, nil)
+	}
+	if err != nil {
+		p.API.LogWarn("Failed to submit standup response", "post_id", post.Id, "err", err.Error())
+		p.API.SendEphemeralPost(user.Id, &model.Post{
+			ChannelId: post.ChannelId,
+			RootId:    post.RootId,
+			UserId:    string(botID),
+			Message:   "Your standup response couldn't be submitted to Parabol, please try again later or respond in Parabol.",
+		})
+		return
+	}
+
+	if _, appErr := p.API.AddReaction(&model.Reaction{
+		UserId:    string(botID),
+		PostId:    post.Id,
+		EmojiName: standupReplyReaction,
+	}); appErr != nil {
+		p.API.LogWarn("Failed to confirm standup response", "post_id", post.Id, "err", appErr.Error())
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseStandupReply(t *testing.T) {
+	for name, tc := range map[string]struct {
+		message string
+		expect  standupReply
+	}{
+		"plain text": {
+			message: "Worked on the release, no blockers",
+			expect:  standupReply{Content: "Worked on the release, no blockers"},
+		},
+		"sections with colons": {
+			message: "Yesterday: fixed the login\nToday: release\n- announce it\nBlockers: none",
+			expect: standupReply{
+				Content:   "Yesterday: fixed the login\nToday: release\n- announce it\nBlockers: none",
+				Yesterday: "fixed the login",
+				Today:     "release\n- announce it",
+				Blockers:  "none",
+			},
+		},
+		"markdown headings": {
+			message: "**Yesterday**\nReviews\n\n### today\nPlanning\n__Blocker:__ waiting for design",
+			expect: standupReply{
+				Content:   "**Yesterday**\nReviews\n\n### today\nPlanning\n__Blocker:__ waiting for design",
+				Yesterday: "Reviews",
+				Today:     "Planning",
+				Blockers:  "waiting for design",
+			},
+		},
+		"words in a sentence are no section": {
+			message: "Today I learned something",
+			expect:  standupReply{Content: "Today I learned something"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := parseStandupReply(tc.message); got != tc.expect {
+				t.Fatalf("expected %+v, got %+v", tc.expect, got)
+			}
+		})
+	}
+}
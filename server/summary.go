@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	maxSummaryLength = 1 << 20
+	maxSummaryItems  = 500
+	maxSummaryText   = 4000
+)
+
+// parabolUser references a Parabol user, who is mentioned if linked to a Mattermost user and
+// called by name otherwise.
+type parabolUser struct {
+	UserID string `json:"userId,omitempty"`
+	Email  string `json:"email,omitempty"`
+	Name   string `json:"name"`
+}
+
+// meetingSummary is sent by Parabol when a meeting ends.
+type meetingSummary struct {
+	MeetingID   string              `json:"meetingId"`
+	MeetingName string              `json:"meetingName"`
+	MeetingURL  string              `json:"meetingUrl"`
+	MeetingType string              `json:"meetingType,omitempty"`
+	TeamName    string              `json:"teamName,omitempty"`
+	Facilitator *parabolUser        `json:"facilitator,omitempty"`
+	Themes      []summaryTheme      `json:"themes,omitempty"`
+	Discussions []summaryDiscussion `json:"discussions,omitempty"`
+	Tasks       []summaryTask       `json:"tasks,omitempty"`
+}
+
+// summaryTheme groups the anonymous reflections of a retrospective.
+type summaryTheme struct {
+	Title       string   `json:"title"`
+	Votes       int      `json:"votes,omitempty"`
+	Reflections []string `json:"reflections"`
+}
+
+type summaryDiscussion struct {
+	Topic    string           `json:"topic"`
+	Votes    int              `json:"votes,omitempty"`
+	Comments []summaryComment `json:"comments,omitempty"`
+}
+
+type summaryComment struct {
+	Author *parabolUser `json:"author,omitempty"`
+	Text   string       `json:"text"`
+}
+
+type summaryTask struct {
+	Content  string       `json:"content"`
+	Assignee *parabolUser `json:"assignee,omitempty"`
+	URL      string       `json:"url,omitempty"`
+}
+
+// parseSummary decodes and validates a meeting summary. Unknown fields are rejected.
+func parseSummary(r io.Reader) (*meetingSummary, error) {
+	raw, err := io.ReadAll(io.LimitReader(r, maxSummaryLength+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read summary")
+	}
+	if len(raw) > maxSummaryLength {
+		return nil, invalid("summary is larger than %d bytes", maxSummaryLength)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	var s meetingSummary
+	if err := decoder.Decode(&s); err != nil {
+		return nil, invalid("invalid summary: %s", err)
+	}
+	if decoder.More() {
+		return nil, invalid("unexpected data after the summary")
+	}
+	return &s, s.validate()
+}
+
+func (s *meetingSummary) validate() error {
+	if s.MeetingName == "" || s.MeetingURL == "" {
+		return invalid("meetingName and meetingUrl are required")
+	}
+	if err := checkLength("meetingName", s.MeetingName, maxAttachmentShortText); err != nil {
+		return err
+	}
+	if err := checkURL("meetingUrl", s.MeetingURL); err != nil {
+		return err
+	}
+	if err := checkSummaryUser("facilitator", s.Facilitator); err != nil {
+		return err
+	}
+	if len(s.Themes) > maxSummaryItems || len(s.Discussions) > maxSummaryItems || len(s.Tasks) > maxSummaryItems {
+		return invalid("a summary has at most %d themes, discussions and tasks each", maxSummaryItems)
+	}
+	for i, theme := range s.Themes {
+		if err := checkLength(fmt.Sprintf("themes[%d].title", i), theme.Title, maxAttachmentShortText); err != nil {
+			return err
+		}
+		if len(theme.Reflections) > maxSummaryItems {
+			return invalid("themes[%d] has more than %d reflections", i, maxSummaryItems)
+		}
+		for j, reflection := range theme.Reflections {
+			if err := checkLength(fmt.Sprintf("themes[%d].reflections[%d]", i, j), reflection, maxSummaryText); err != nil {
+				return err
+			}
+		}
+	}
+	for i, discussion := range s.Discussions {
+		if err := checkLength(fmt.Sprintf("discussions[%d].topic", i), discussion.Topic, maxSummaryText); err != nil {
+			return err
+		}
+		if len(discussion.Comments) > maxSummaryItems {
+			return invalid("discussions[%d] has more than %d comments", i, maxSummaryItems)
+		}
+		for j, comment := range discussion.Comments {
+			if err := checkLength(fmt.Sprintf("discussions[%d].comments[%d].text", i, j), comment.Text, maxSummaryText); err != nil {
+				return err
+			}
+			if err := checkSummaryUser(fmt.Sprintf("discussions[%d].comments[%d].author", i, j), comment.Author); err != nil {
+				return err
+			}
+		}
+	}
+	for i, task := range s.Tasks {
+		if err := checkLength(fmt.Sprintf("tasks[%d].content", i), task.Content, maxSummaryText); err != nil {
+			return err
+		}
+		if err := checkURL(fmt.Sprintf("tasks[%d].url", i), task.URL); err != nil {
+			return err
+		}
+		if err := checkSummaryUser(fmt.Sprintf("tasks[%d].assignee", i), task.Assignee); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSummaryUser limits the name of a user of the summary like the users of a notification.
+func checkSummaryUser(field string, user *parabolUser) error {
+	if user == nil {
+		return nil
+	}
+	return checkLength(field+".name", user.Name, maxAttachmentShortText)
+}
+
+// summaryText makes text from Parabol safe to embed in a list item. It is kept on one line, and
+// mentions like @channel are broken up so a reflection can't notify anybody.
+func summaryText(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	return strings.ReplaceAll(text, "@", "@\u200b")
+}
+
+func plural(count int, noun string) string {
+	if count == 1 {
+		return fmt.Sprintf("1 %s", noun)
+	}
+	return fmt.Sprintf("%d %ss", count, noun)
+}
+
+// headline is the short message posted to the channel.
+func (s *meetingSummary) headline(mention func(*parabolUser) string) string {
+	var counts []string
+	reflections := 0
+	for _, theme := range s.Themes {
+		reflections += len(theme.Reflections)
+	}
+	if len(s.Themes) > 0 {
+		counts = append(counts, plural(len(s.Themes), "theme"), plural(reflections, "reflection"))
+	}
+	if len(s.Discussions) > 0 {
+		counts = append(counts, plural(len(s.Discussions), "discussion"))
+	}
+	if len(s.Tasks) > 0 {
+		counts = append(counts, plural(len(s.Tasks), "new task"))
+	}
+
+	text := strings.Builder{}
+	fmt.Fprintf(&text, "**[%s](%s)** has ended", escapeLinkText(summaryText(s.MeetingName)), s.MeetingURL)
+	if s.Facilitator != nil {
+		fmt.Fprintf(&text, ", facilitated by %s", mention(s.Facilitator))
+	}
+	text.WriteString(".")
+	if len(counts) > 0 {
+		fmt.Fprintf(&text, " %s, see the thread for details.", strings.Join(counts, ", "))
+	}
+	return text.String()
+}
+
+// details renders the sections of the summary as Markdown, each section a list of lines.
+func (s *meetingSummary) details(mention func(*parabolUser) string) [][]string {
+	var sections [][]string
+	if len(s.Themes) > 0 {
+		section := []string{"#### Reflections"}
+		for _, theme := range s.Themes {
+			title := "**" + summaryText(theme.Title) + "**"
+			if theme.Votes > 0 {
+				title += " · " + plural(theme.Votes, "vote")
+			}
+			section = append(section, "", title)
+			for _, reflection := range theme.Reflections {
+				section = append(section, "- "+summaryText(reflection))
+			}
+		}
+		sections = append(sections, section)
+	}
+	if len(s.Discussions) > 0 {
+		section := []string{"#### Discussions"}
+		for _, discussion := range s.Discussions {
+			topic := "**" + summaryText(discussion.Topic) + "**"
+			if discussion.Votes > 0 {
+				topic += " · " + plural(discussion.Votes, "vote")
+			}
+			section = append(section, "", topic)
+			for _, comment := range discussion.Comments {
+				line := "- "
+				if comment.Author != nil {
+					line += mention(comment.Author) + ": "
+				}
+				section = append(section, line+summaryText(comment.Text))
+			}
+		}
+		sections = append(sections, section)
+	}
+	if len(s.Tasks) > 0 {
+		section := []string{"#### New tasks"}
+		for _, task := range s.Tasks {
+			line := "- [ ] " + summaryText(task.Content)
+			if task.Assignee != nil {
+				line += " → " + mention(task.Assignee)
+			}
+			if task.URL != "" {
+				line += fmt.Sprintf(" ([open](%s))", task.URL)
+			}
+			section = append(section, line)
+		}
+		sections = append(sections, section)
+	}
+	return sections
+}
+
+// splitMessage joins the sections into as few messages as possible, none longer than limit
+// characters. Sections are split between lines if needed, overlong lines are cut.
+func splitMessage(sections [][]string, limit int) []string {
+	var messages []string
+	current := strings.Builder{}
+	length := 0
+	add := func(line string, separator string) {
+		lineLength := utf8.RuneCountInString(line)
+		if lineLength > limit {
+			line = string([]rune(line)[:limit-1]) + "…"
+			lineLength = limit
+		}
+		if length > 0 && length+utf8.RuneCountInString(separator)+lineLength > limit {
+			messages = append(messages, current.String())
+			current.Reset()
+			length = 0
+		}
+		if length > 0 {
+			current.WriteString(separator)
+			length += utf8.RuneCountInString(separator)
+		}
+		current.WriteString(line)
+		length += lineLength
+	}
+	for _, section := range sections {
+		for i, line := range section {
+			separator := "\n"
+			if i == 0 {
+				separator = "\n\n"
+			}
+			add(line, separator)
+		}
+	}
+	if length > 0 {
+		messages = append(messages, current.String())
+	}
+	return messages
+}
+
+// notifySummary posts the summary of a meeting to the channel: a short headline, and the details
+// in its thread. Parabol may retry if the request fails, nothing is left behind in that case.
+func (p *Plugin) notifySummary(w http.ResponseWriter, r *http.Request) {
+	channelID := mux.Vars(r)["channelID"]
+	connection := p.verifyChannelNotification(w, r, channelID)
+	if connection == nil {
+		return
+	}
+	if p.channelArchived(channelID) {
+		p.writeError(w, r, http.StatusGone, errCodeChannelArchived, "Channel is archived", nil)
+		return
+	}
+	summary, err := parseSummary(r.Body)
+	if err != nil {
+		p.writeNotificationError(w, r, err)
+		return
+	}
+
+	mention := p.mentionsFor(connection)
+	root, err := p.createBotPost(&model.Post{ChannelId: channelID, Message: summary.headline(mention)})
+	if err != nil {
+		p.metrics.inc(metricNotifications, "failed")
+		p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error posting summary", err)
+		return
+	}
+	for _, message := range splitMessage(summary.details(mention), maxMessageLength) {
+		if _, err := p.createBotPost(&model.Post{ChannelId: channelID, RootId: root.Id, Message: message}); err != nil {
+			if appErr := p.API.DeletePost(root.Id); appErr != nil {
+				p.API.LogError("Failed to delete incomplete summary", "post_id", root.Id, "err", appErr.Error())
+			}
+			p.metrics.inc(metricNotifications, "failed")
+			p.writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Error posting summary", err)
+			return
+		}
+	}
+
+	p.metrics.inc(metricNotifications, "created")
+	writeJSON(w, http.StatusCreated, struct {
+		ID string `json:"id"`
+	}{
+		ID: root.Id,
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSummaryGolden renders every summary in testdata/summaries and compares the headline and
+// the thread, or the validation error, with the .golden file next to it.
+func TestSummaryGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "summaries", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no test summaries found")
+	}
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".json")
+		t.Run(name, func(t *testing.T) {
+			raw, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []byte
+			summary, err := parseSummary(bytes.NewReader(raw))
+			if err != nil {
+				got = []byte("error: " + err.Error() + "\n")
+			} else {
+				messages := append([]string{summary.headline(testMention)}, splitMessage(summary.details(testMention), maxMessageLength)...)
+				got = []byte(strings.Join(messages, "\n---\n") + "\n")
+			}
+
+			golden := strings.TrimSuffix(input, ".json") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, got, 0o600); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("missing golden file, run go test -update: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("unexpected result for %s\ngot:\n%s\nwant:\n%s", input, got, want)
+			}
+		})
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	for name, tc := range map[string]struct {
+		sections [][]string
+		limit    int
+		expect   []string
+	}{
+		"fits": {
+			sections: [][]string{{"# A", "- a"}, {"# B", "- b"}},
+			limit:    100,
+			expect:   []string{"# A\n- a\n\n# B\n- b"},
+		},
+		"split between sections": {
+			sections: [][]string{{"# A", "- a"}, {"# B", "- b"}},
+			limit:    10,
+			expect:   []string{"# A\n- a", "# B\n- b"},
+		},
+		"split within a section": {
+			sections: [][]string{{"# A", "- a", "- b", "- c"}},
+			limit:    11,
+			expect:   []string{"# A\n- a\n- b", "- c"},
+		},
+		"overlong line is cut": {
+			sections: [][]string{{"# A", "- abcdefghijk"}},
+			limit:    8,
+			expect:   []string{"# A", "- abcde…"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := splitMessage(tc.sections, tc.limit)
+			if strings.Join(got, "|") != strings.Join(tc.expect, "|") {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
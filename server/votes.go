@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/pkg/errors"
+)
+
+const (
+	votePostPrefix = "vote_post_"
+
+	// votePostTTL is how long reactions on a notification are forwarded as votes.
+	votePostTTL     = 30 * 24 * time.Hour
+	voteTimeout     = 10 * time.Second
+	maxVoteEmojis   = 20
+	maxVoteValueLen = 64
+)
+
+// defaultVoteEmojis map reactions to votes unless the Vote Emojis setting or the notification
+// say otherwise: a yes/no vote and the common sprint poker scale.
+var defaultVoteEmojis = map[string]string{
+	"+1":       "yes",
+	"-1":       "no",
+	"one":      "1",
+	"two":      "2",
+	"three":    "3",
+	"five":     "5",
+	"eight":    "8",
+	"question": "?",
+}
+
+// notificationVote makes reactions on a notification count as votes on a Parabol poll or story.
+// Emojis overrides the configured emojis for this notification, e.g. one per poll option.
+type notificationVote struct {
+	ID     string            `json:"id"`
+	Emojis map[string]string `json:"emojis,omitempty"`
+}
+
+// votePost is stored for every notification accepting votes, by post ID.
+type votePost struct {
+	VoteID     string            `json:"voteId"`
+	Connection string            `json:"connection"`
+	ChannelID  string            `json:"channelId"`
+	Emojis     map[string]string `json:"emojis,omitempty"`
+}
+
+// voteRequest is sent to Parabol when a user adds or removes a vote reaction.
+type voteRequest struct {
+	VoteID    string `json:"voteId"`
+	Value     string `json:"value"`
+	Removed   bool   `json:"removed,omitempty"`
+	Email     string `json:"email"`
+	UserID    string `json:"userId,omitempty"`
+	PostID    string `json:"postId"`
+	ChannelID string `json:"channelId"`
+}
+
+func validateVoteEmojis(field string, emojis map[string]string) error {
+	if len(emojis) > maxVoteEmojis {
+		return invalid("%s has more than %d emojis", field, maxVoteEmojis)
+	}
+	for _, emoji := range sortedKeys(emojis) {
+		if len(emoji) > model.EmojiNameMaxLength || !model.IsValidAlphaNumHyphenUnderscorePlus(emoji) {
+			return invalid("%s.%s is not a valid emoji name", field, emoji)
+		}
+		if emojis[emoji] == "" {
+			return invalid("%s.%s needs a value", field, emoji)
+		}
+		if err := checkLength(field+"."+emoji, emojis[emoji], maxVoteValueLen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *notificationVote) validate() error {
+	if !validActionID.MatchString(v.ID) {
+		return invalid("vote.id must match %s", validActionID)
+	}
+	return validateVoteEmojis("vote.emojis", v.Emojis)
+}
+
+// parseVoteEmojis parses the Vote Emojis setting, which replaces the defaults if set.
+func parseVoteEmojis(raw string) (map[string]string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return defaultVoteEmojis, nil
+	}
+	var emojis map[string]string
+	if err := json.Unmarshal([]byte(raw), &emojis); err != nil {
+		return nil, errors.Wrap(err, "vote emojis are not valid JSON")
+	}
+	if err := validateVoteEmojis("vote emojis", emojis); err != nil {
+		return nil, err
+	}
+	return emojis, nil
+}
+
+// trackVotePost remembers that reactions on the post are votes.
+func (p *Plugin) trackVotePost(postID string, item *outboxItem) error {
+	raw, err := json.Marshal(&votePost{
+		VoteID:     item.Vote.ID,
+		Connection: item.Connection,
+		ChannelID:  item.ChannelID,
+		Emojis:     item.Vote.Emojis,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize vote post")
+	}
+	if appErr := p.API.KVSetWithExpiry(votePostPrefix+postID, raw, int64(votePostTTL.Seconds())); appErr != nil {
+		return errors.Wrap(appErr, "failed to store vote post")
+	}
+	return nil
+}
+
+func (p *Plugin) getVotePost(postID string) (*votePost, error) {
+	raw, appErr := p.API.KVGet(votePostPrefix + postID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to read vote post")
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	var post votePost
+	if err := json.Unmarshal(raw, &post); err != nil {
+		return nil, errors.Wrap(err, "invalid vote post")
+	}
+	return &post, nil
+}
+
+// ReactionHasBeenAdded forwards reactions on vote notifications to Parabol.
+func (p *Plugin) ReactionHasBeenAdded(_ *plugin.Context, reaction *model.Reaction) {
+	p.forwardVote(reaction, false)
+}
+
+// ReactionHasBeenRemoved withdraws the vote of a removed reaction.
+func (p *Plugin) ReactionHasBeenRemoved(_ *plugin.Context, reaction *model.Reaction) {
+	p.forwardVote(reaction, true)
+}
+
+func (p *Plugin) forwardVote(reaction *model.Reaction, removed bool) {
+	post, err := p.getVotePost(reaction.PostId)
+	if err != nil {
+		p.API.LogError("Failed to look up vote post", "post_id", reaction.PostId, "err", err.Error())
+		return
+	}
+	if post == nil {
+		return
+	}
+	emojis := post.Emojis
+	if len(emojis) == 0 {
+		emojis = p.getConfiguration().voteEmojis
+	}
+	value, ok := emojis[reaction.EmojiName]
+	if !ok {
+		return
+	}
+	connection := p.getConfiguration().connectionByName(post.Connection)
+	if connection == nil {
+		p.API.LogWarn("Connection of vote post no longer exists", "post_id", reaction.PostId, "connection", post.Connection)
+		return
+	}
+	user, appErr := p.API.GetUser(reaction.UserId)
+	if appErr != nil || user.IsBot {
+		return
+	}
+
+	request := voteRequest{
+		VoteID:    post.VoteID,
+		Value:     value,
+		Removed:   removed,
+		Email:     user.Email,
+		PostID:    reaction.PostId,
+		ChannelID: post.ChannelID,
+	}
+	if linked, err := p.identityForUser(connection, user.Id); err == nil {
+		request.UserID = linked.ParabolUserID
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), voteTimeout)
+	defer cancel()
+	if err := p.callParabol(ctx, connection, "/mattermost/vote", &request, nil); err != nil {
+		p.API.LogWarn("Failed to forward vote to Parabol", "post_id", reaction.PostId, "connection", connection.Name, "err", err.Error())
+		botID, appErr := p.API.KVGet(botUserID)
+		if appErr != nil {
+			p.API.LogError("Failed to get bot user", "err", appErr.Error())
+			return
+		}
+		p.API.SendEphemeralPost(user.Id, &model.Post{
+			ChannelId: post.ChannelID,
+			RootId:    reaction.PostId,
+			UserId:    string(botID),
+			Message:   "Parabol couldn't record your vote, please try again later or vote in Parabol.",
+		})
+	}
+}
@@ -3,6 +3,7 @@ import React, {useEffect, useState} from 'react'
 import {useSelector} from 'react-redux'
 import styled from 'styled-components'
 import {Client4} from 'mattermost-redux/client'
+import {getCurrentTeamId} from 'mattermost-redux/selectors/entities/teams'
 
 import {getPluginServerRoute} from '../selectors'
 
@@ -25,6 +26,7 @@ type Props = {
 
 const PanelTitle = ({iconUrl}: Props) => {
   const pluginServerRoute = useSelector(getPluginServerRoute)
+  const teamId = useSelector(getCurrentTeamId)
   const [parabolURL, setParabolURL] = useState<string>()
 
   useEffect(() => {
@@ -33,15 +35,16 @@ const PanelTitle = ({iconUrl}: Props) => {
     }
     const fetchConfig = async () => {
       try {
-        const response = await fetch(`${pluginServerRoute}/config`, Client4.getOptions({method: 'GET'}))
+        // The team selects the Parabol instance if teams are served by different instances.
+        const response = await fetch(`${pluginServerRoute}/config?teamId=${encodeURIComponent(teamId)}`, Client4.getOptions({method: 'GET'}))
         const data = await response.json()
-        setParabolURL(data.parabolURL)
+        setParabolURL(data.parabolUrl)
       } catch (error) {
         console.log('Failed to fetch config', error)
       }
     }
     fetchConfig()
-  }, [pluginServerRoute])
+  }, [pluginServerRoute, teamId])
 
   return (
     <Panel>
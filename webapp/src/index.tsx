@@ -1,9 +1,11 @@
 import React from 'react'
 import {Store, AnyAction} from 'redux'
 
+import {Post} from '@mattermost/types/posts'
 import {GlobalState} from '@mattermost/types/store'
 
 import {createInstance} from '@module-federation/enhanced/runtime'
+import {Client4} from 'mattermost-redux/client'
 
 import manifest from '@/manifest'
 import {PluginRegistry} from '@/types/mattermost-webapp'
@@ -19,6 +21,25 @@ export default class Plugin {
   public async initialize(registry: PluginRegistry, store: Store<GlobalState, AnyAction>) {
     const pluginServerRoute = getPluginServerRoute(store.getState())
 
+    // The plugin server confirms with an ephemeral post, so the author is never revealed.
+    const addReflection = async (postId: string, thread: boolean) => {
+      try {
+        await fetch(`${pluginServerRoute}/reflect`, Client4.getOptions({method: 'POST', body: JSON.stringify({postId, thread})}))
+      } catch (error) {
+        console.log('Failed to add reflection', error)
+      }
+    }
+    registry.registerPostDropdownMenuAction(
+      'Add as reflection',
+      (postId: string) => addReflection(postId, false),
+      () => true,
+    )
+    registry.registerPostDropdownMenuAction(
+      'Add thread as reflection',
+      (postId: string) => addReflection(postId, true),
+      (post: Post) => Boolean(post.root_id) || post.reply_count > 0,
+    )
+
     try {
       const mf = createInstance({
         name: 'parabol-main',
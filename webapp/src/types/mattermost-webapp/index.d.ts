@@ -527,11 +527,11 @@ export interface PluginRegistry {
   registerPostDropdownMenuAction(
     ...args: [
             text: React.ReactNode,
-            action: () => void,
+            action: (postId: string) => void,
             filter: (post: Post) => boolean
     ] | [{
       text: React.ReactNode;
-      action: () => void;
+      action: (postId: string) => void;
       filter: (post: Post) => boolean;
     }]
   ): UniqueIdentifier;